@@ -1,36 +1,97 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 
 	admissionv1 "k8s.io/api/admission/v1"
-	appsv1 "k8s.io/api/apps/v1"
-	batchv1 "k8s.io/api/batch/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 )
 
 var (
 	codecs       = serializer.NewCodecFactory(runtime.NewScheme())
 	deserializer = codecs.UniversalDeserializer()
+
+	// admissionCodecs decode reviews of every supported admission api
+	// version.
+	admissionScheme = newAdmissionScheme()
+	admissionCodecs = serializer.NewCodecFactory(admissionScheme)
 )
 
+func newAdmissionScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	utilruntime.Must(admissionv1.AddToScheme(scheme))
+	utilruntime.Must(admissionv1beta1.AddToScheme(scheme))
+	return scheme
+}
+
+// AdmissionReview is handled as admission.k8s.io/v1 whatever the version
+// of the request, version is the one to reply in.
 type AdmissionReview struct {
 	admissionv1.AdmissionReview
-	images []Image
+	version    schema.GroupVersion
+	rules      ResourceRules
+	images     []Image
+	containers []Container
+	// oldImages and oldContainers are those of the old object on UPDATE
+	// and DELETE.
+	oldImages     []Image
+	oldContainers []Container
+	// exemption is set when the workload is exempted from the policy.
+	exemption *Exemption
+	// skipped is set when the request does not change any image, and
+	// skipReason tells why.
+	skipped    bool
+	skipReason string
+	violations []Violation
+	// unknownKind is set when images could not be extracted from the
+	// kind of the request object.
+	unknownKind bool
+}
+
+// Container is a container image found in a pod spec, path is the JSON
+// pointer to its image field. err is set when the image reference could
+// not be parsed.
+type Container struct {
+	name  string
+	path  string
+	ref   string
+	image Image
+	err   error
 }
 
 func NewAdmissionReview(b []byte) (*AdmissionReview, error) {
-	// Decode the bytes
-	admissionReview := &AdmissionReview{}
-	if _, _, err := deserializer.Decode(b, nil, admissionReview); err != nil {
+	// Decode the bytes, reviews without apiVersion default to v1.
+	defaults := admissionv1.SchemeGroupVersion.WithKind("AdmissionReview")
+	obj, gvk, err := admissionCodecs.UniversalDeserializer().Decode(b, &defaults, nil)
+	if err != nil {
 		return &AdmissionReview{}, NewApiError(http.StatusBadRequest, err.Error())
 	}
 
+	admissionReview := &AdmissionReview{version: gvk.GroupVersion()}
+	switch review := obj.(type) {
+	case *admissionv1.AdmissionReview:
+		admissionReview.AdmissionReview = *review
+	case *admissionv1beta1.AdmissionReview:
+		admissionReview.Request = fromV1beta1Request(review.Request)
+	default:
+		return &AdmissionReview{}, NewApiError(http.StatusBadRequest, fmt.Sprintf("unsupported admission review %s", gvk))
+	}
+	if admissionReview.Request == nil {
+		return &AdmissionReview{}, NewApiError(http.StatusBadRequest, "admission review has no request")
+	}
+
 	admissionReview.images = []Image{}
+	admissionReview.containers = []Container{}
 	return admissionReview, nil
 }
 
@@ -42,191 +103,392 @@ func MustAdmissionReview(b []byte) *AdmissionReview {
 	return admissionReview
 }
 
-func handleAdmissionReview(b []byte) (admissionv1.AdmissionReview, error) {
+func handleAdmissionReview(b []byte, rules ResourceRules, scope *Scope, policy *Policy) (*AdmissionReview, error) {
 	// Decode the request body
 	admissionReview, err := NewAdmissionReview(b)
 	if err != nil {
-		return admissionv1.AdmissionReview{}, err
+		return nil, err
+	}
+	admissionReview.rules = rules
+
+	if ok, err := admissionReview.inScope(scope); !ok || err != nil {
+		return admissionReview, err
 	}
 
 	err = admissionReview.handleResource()
+	if errors.Is(err, ErrUnknownKind) {
+		admissionReview.unknownKind = true
+		admissionReview.setResponse(policy.UnknownKindResponse(admissionReview.kind()))
+		return admissionReview, nil
+	}
 	if err != nil {
-		return admissionv1.AdmissionReview{}, err
+		return nil, err
 	}
 
-	// TODO test with our AdmissionReview
 	// Construct the response, which is just an AdmissionReview.
 	admissionResponse := &admissionv1.AdmissionResponse{}
 	admissionResponse.Allowed = true
 
-	admissionReview.Response = admissionResponse
-	admissionReview.SetGroupVersionKind(admissionReview.GroupVersionKind())
-	admissionReview.Response.UID = admissionReview.Request.UID
+	// Updates that leave the images alone, such as scaling or relabeling,
+	// were checked and reported when the images were set.
+	if admissionReview.skipped {
+		reviewsSkipped.WithLabelValues(admissionReview.Request.Kind.Kind, admissionReview.skipReason).Inc()
+		admissionReview.setResponse(admissionResponse)
+		return admissionReview, nil
+	}
+
+	admissionReview.violations = policy.Evaluate(admissionReview.containers)
+	exemption, requested := policy.Exemption(admissionReview)
+	if exemption != nil {
+		admissionReview.exemption = exemption
+		admissionReview.violations = exempt(admissionReview.violations)
+	} else if requested {
+		admissionResponse.Warnings = append(admissionResponse.Warnings, fmt.Sprintf("annotation %s ignored, %s is not allowed to exempt workloads", ExemptAnnotation, admissionReview.Request.UserInfo.Username))
+	}
+	for _, violation := range admissionReview.violations {
+		if violation.mode != PolicyModeEnforce {
+			log.Printf("%s: %s %s/%s %s", violation.mode, admissionReview.Request.Kind.Kind, admissionReview.Request.Namespace, admissionReview.Request.Name, violation)
+		}
+	}
+	for _, violation := range filterViolations(admissionReview.violations, PolicyModeWarn) {
+		admissionResponse.Warnings = append(admissionResponse.Warnings, violation.String())
+	}
+	if denied := filterViolations(admissionReview.violations, PolicyModeEnforce); len(denied) > 0 {
+		admissionResponse.Allowed = false
+		admissionResponse.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: violationsMessage(denied),
+		}
+	}
 
-	return admissionReview.AdmissionReview, nil
+	admissionReview.setResponse(admissionResponse)
+	return admissionReview, nil
 }
 
-func (r *AdmissionReview) handleResource() error {
-	s := (r.Request.Kind.Kind)
-	switch s {
-	case "Pod":
-		return r.handlePodResource()
-	case "Job":
-		return r.handleJobResource()
-	case "CronJob":
-		return r.handleCronjobResource()
-	case "Deployment":
-		return r.handleDeploymentResource()
-	case "DaemonSet":
-		return r.handleDaemonsetResource()
-	case "StatefulSet":
-		return r.handleStatefulsetResource()
-	case "ReplicaSet":
-		return r.handleReplicasetResource()
-	default:
-		return NewApiError(http.StatusNotImplemented, fmt.Sprintf("resource kind %s.%s, not implemented", r.Request.Kind.Version, s))
+func handleMutationReview(b []byte, rules ResourceRules, scope *Scope, mutator *Mutator) (*AdmissionReview, error) {
+	// Decode the request body
+	admissionReview, err := NewAdmissionReview(b)
+	if err != nil {
+		return nil, err
+	}
+	admissionReview.rules = rules
+
+	if ok, err := admissionReview.inScope(scope); !ok || err != nil {
+		return admissionReview, err
 	}
+
+	// Unknown kinds have nothing to rewrite, so they are left untouched.
+	err = admissionReview.handleResource()
+	if err != nil && !errors.Is(err, ErrUnknownKind) {
+		return nil, err
+	}
+
+	admissionResponse := &admissionv1.AdmissionResponse{}
+	admissionResponse.Allowed = true
+
+	patches := mutator.Patch(admissionReview.containers)
+	if len(patches) > 0 {
+		patch, err := json.Marshal(patches)
+		if err != nil {
+			return nil, err
+		}
+		patchType := admissionv1.PatchTypeJSONPatch
+		admissionResponse.Patch = patch
+		admissionResponse.PatchType = &patchType
+	}
+
+	admissionReview.setResponse(admissionResponse)
+	return admissionReview, nil
 }
 
-func (r *AdmissionReview) handlePodResource() error {
-	s := (r.Request.Kind.Version)
-	switch s {
-	case "v1":
-		return r.handlePodV1Resource()
-	default:
-		return NewApiError(http.StatusNotImplemented, fmt.Sprintf("resource kind %s.%s, not implemented", s, r.Request.Kind.Kind))
+// inScope checks the request against the scope. Requests out of scope are
+// answered right away, allowed and skipped.
+func (r *AdmissionReview) inScope(scope *Scope) (bool, error) {
+	ok, err := scope.Match(r)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		r.skipped = true
+		response := &admissionv1.AdmissionResponse{}
+		response.Allowed = true
+		r.setResponse(response)
 	}
+	return ok, nil
 }
 
-func (r *AdmissionReview) handlePodV1Resource() error {
-	rawRequest := r.Request.Object.Raw
-	pod := corev1.Pod{}
-	if _, _, err := deserializer.Decode(rawRequest, nil, &pod); err != nil {
-		return NewApiError(http.StatusBadRequest, err.Error())
+// newFailureReview returns a review answering b with response. b is
+// decoded leniently as it may be what failed, the response carries the
+// request UID when it can be found.
+func newFailureReview(b []byte, response *admissionv1.AdmissionResponse) *AdmissionReview {
+	admissionReview := &AdmissionReview{}
+	if err := json.Unmarshal(b, &admissionReview.AdmissionReview); err != nil || admissionReview.Request == nil {
+		admissionReview.Request = &admissionv1.AdmissionRequest{}
 	}
-	return r.handlePodSpec(&pod.Spec)
+	admissionReview.version = admissionv1.SchemeGroupVersion
+	if admissionReview.APIVersion == admissionv1beta1.SchemeGroupVersion.String() {
+		admissionReview.version = admissionv1beta1.SchemeGroupVersion
+	}
+	admissionReview.setResponse(response)
+	return admissionReview
 }
 
-func (r *AdmissionReview) handleJobResource() error {
-	s := (r.Request.Kind.Version)
-	switch s {
-	case "v1":
-		return r.handleJobV1Resource()
-	default:
-		return NewApiError(http.StatusNotImplemented, fmt.Sprintf("resource kind %s.%s, not implemented", s, r.Request.Kind.Kind))
+// objectMeta decodes the metadata of a raw object.
+func objectMeta(raw []byte) (*metav1.PartialObjectMetadata, error) {
+	object := &metav1.PartialObjectMetadata{}
+	if _, _, err := deserializer.Decode(raw, nil, object); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, err.Error())
 	}
+	return object, nil
 }
 
-func (r *AdmissionReview) handleJobV1Resource() error {
-	rawRequest := r.Request.Object.Raw
-	resource := batchv1.Job{}
-	if _, _, err := deserializer.Decode(rawRequest, nil, &resource); err != nil {
-		return NewApiError(http.StatusBadRequest, err.Error())
+// kind returns the group, version and kind of the request object.
+func (r *AdmissionReview) kind() string {
+	if r.Request.Kind.Group == "" {
+		return r.Request.Kind.Version + "/" + r.Request.Kind.Kind
 	}
-	return r.handlePodSpec(&resource.Spec.Template.Spec)
+	return r.Request.Kind.Group + "/" + r.Request.Kind.Version + "/" + r.Request.Kind.Kind
 }
 
-func (r *AdmissionReview) handleCronjobResource() error {
-	s := (r.Request.Kind.Version)
-	switch s {
-	case "v1":
-		return r.handleCronjobV1Resource()
-	default:
-		return NewApiError(http.StatusNotImplemented, fmt.Sprintf("resource kind %s.%s, not implemented", s, r.Request.Kind.Kind))
+func (r *AdmissionReview) setResponse(response *admissionv1.AdmissionResponse) {
+	r.Response = response
+	r.SetGroupVersionKind(admissionv1.SchemeGroupVersion.WithKind("AdmissionReview"))
+	r.Response.UID = r.Request.UID
+}
+
+// Reply returns the response as a review in the version of the request.
+func (r *AdmissionReview) Reply() runtime.Object {
+	if r.version == admissionv1beta1.SchemeGroupVersion {
+		review := &admissionv1beta1.AdmissionReview{
+			Response: toV1beta1Response(r.Response),
+		}
+		review.SetGroupVersionKind(admissionv1beta1.SchemeGroupVersion.WithKind("AdmissionReview"))
+		return review
 	}
+	return &r.AdmissionReview
 }
 
-func (r *AdmissionReview) handleCronjobV1Resource() error {
-	rawRequest := r.Request.Object.Raw
-	resource := batchv1.CronJob{}
-	if _, _, err := deserializer.Decode(rawRequest, nil, &resource); err != nil {
-		return NewApiError(http.StatusBadRequest, err.Error())
+// fromV1beta1Request converts a v1beta1 request, the versions only differ
+// in their defaults.
+func fromV1beta1Request(r *admissionv1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if r == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                r.UID,
+		Kind:               r.Kind,
+		Resource:           r.Resource,
+		SubResource:        r.SubResource,
+		RequestKind:        r.RequestKind,
+		RequestResource:    r.RequestResource,
+		RequestSubResource: r.RequestSubResource,
+		Name:               r.Name,
+		Namespace:          r.Namespace,
+		Operation:          admissionv1.Operation(r.Operation),
+		UserInfo:           r.UserInfo,
+		Object:             r.Object,
+		OldObject:          r.OldObject,
+		DryRun:             r.DryRun,
+		Options:            r.Options,
 	}
-	return r.handlePodSpec(&resource.Spec.JobTemplate.Spec.Template.Spec)
 }
 
-func (r *AdmissionReview) handleDeploymentResource() error {
-	s := (r.Request.Kind.Version)
-	switch s {
-	case "v1":
-		return r.handleDeploymentV1Resource()
-	default:
-		return NewApiError(http.StatusNotImplemented, fmt.Sprintf("resource kind %s.%s, not implemented", s, r.Request.Kind.Kind))
+func toV1beta1Response(r *admissionv1.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	response := &admissionv1beta1.AdmissionResponse{
+		UID:              r.UID,
+		Allowed:          r.Allowed,
+		Result:           r.Result,
+		Patch:            r.Patch,
+		AuditAnnotations: r.AuditAnnotations,
+		Warnings:         r.Warnings,
+	}
+	if r.PatchType != nil {
+		patchType := admissionv1beta1.PatchType(*r.PatchType)
+		response.PatchType = &patchType
 	}
+	return response
 }
 
-func (r *AdmissionReview) handleDeploymentV1Resource() error {
-	rawRequest := r.Request.Object.Raw
-	resource := appsv1.Deployment{}
-	if _, _, err := deserializer.Decode(rawRequest, nil, &resource); err != nil {
-		return NewApiError(http.StatusBadRequest, err.Error())
+// Reportable tells whether the request changes the inventory. Denied
+// requests, unknown kinds, unchanged updates and dry runs are never
+// persisted by the api server, so they are not reported.
+func (r *AdmissionReview) Reportable() bool {
+	dryRun := r.Request.DryRun != nil && *r.Request.DryRun
+	return r.Response.Allowed && !r.unknownKind && !r.skipped && !dryRun
+}
+
+// Report returns the images found in the request along with the
+// workload they belong to.
+func (r *AdmissionReview) Report() Report {
+	report := Report{
+		Namespace: r.Request.Namespace,
+		Kind:      r.Request.Kind.Kind,
+		Name:      r.Request.Name,
+		Operation: string(r.Request.Operation),
+		Images:    r.images,
+		Added:     subtractImages(r.images, r.oldImages),
+		Removed:   subtractImages(r.oldImages, r.images),
+	}
+	for _, violation := range r.violations {
+		report.Violations = append(report.Violations, violation.String())
 	}
-	return r.handlePodSpec(&resource.Spec.Template.Spec)
+	report.Exemption = r.exemption
+	return report
 }
 
-func (r *AdmissionReview) handleDaemonsetResource() error {
-	s := (r.Request.Kind.Version)
-	switch s {
-	case "v1":
-		return r.handleDaemonsetV1Resource()
+// Reasons of skipped reviews, the reason label of reviewsSkipped.
+const (
+	skipReasonUnchanged   = "unchanged_images"
+	skipReasonSubresource = "subresource"
+)
+
+func (r *AdmissionReview) handleResource() error {
+	switch r.Request.SubResource {
+	case "", "ephemeralcontainers":
 	default:
-		return NewApiError(http.StatusNotImplemented, fmt.Sprintf("resource kind %s.%s, not implemented", s, r.Request.Kind.Kind))
+		// Other subresources, such as status, cannot change images.
+		r.skipped = true
+		r.skipReason = skipReasonSubresource
+		return nil
+	}
+
+	switch r.Request.Operation {
+	case admissionv1.Delete:
+		// The object is going away, its images are only found in the old
+		// object and no longer referenced afterwards.
+		if err := r.handleOldObject(); err != nil {
+			return err
+		}
+		if len(r.Request.Object.Raw) == 0 {
+			return nil
+		}
+	case admissionv1.Update:
+		if err := r.handleOldObject(); err != nil {
+			return err
+		}
+		if err := r.handleObject(r.Request.Object.Raw); err != nil {
+			return err
+		}
+		if len(r.Request.OldObject.Raw) > 0 && sameRefs(r.oldContainers, r.containers) {
+			r.skipped = true
+			r.skipReason = skipReasonUnchanged
+		}
+		return nil
 	}
+	return r.handleObject(r.Request.Object.Raw)
 }
 
-func (r *AdmissionReview) handleDaemonsetV1Resource() error {
-	rawRequest := r.Request.Object.Raw
-	resource := appsv1.DaemonSet{}
-	if _, _, err := deserializer.Decode(rawRequest, nil, &resource); err != nil {
-		return NewApiError(http.StatusBadRequest, err.Error())
+// handleOldObject collects the images of the old object into oldImages.
+func (r *AdmissionReview) handleOldObject() error {
+	if len(r.Request.OldObject.Raw) == 0 {
+		return nil
+	}
+	if err := r.handleObject(r.Request.OldObject.Raw); err != nil {
+		return err
 	}
-	return r.handlePodSpec(&resource.Spec.Template.Spec)
+	r.oldImages = r.images
+	r.oldContainers = r.containers
+	r.images = []Image{}
+	r.containers = []Container{}
+	return nil
 }
 
-func (r *AdmissionReview) handleStatefulsetResource() error {
-	s := (r.Request.Kind.Version)
-	switch s {
-	case "v1":
-		return r.handleStatefulsetV1Resource()
-	default:
-		return NewApiError(http.StatusNotImplemented, fmt.Sprintf("resource kind %s.%s, not implemented", s, r.Request.Kind.Kind))
+// handleObject collects the images of a raw object of the request kind.
+func (r *AdmissionReview) handleObject(raw []byte) error {
+	handler, ok := resourceHandlers.Lookup(r.Request.Kind)
+	if !ok {
+		if rule := r.rules.Match(r.Request.Kind); rule != nil {
+			return r.handleUnstructuredResource(rule, raw)
+		}
+		return fmt.Errorf("%w: %s", ErrUnknownKind, r.kind())
+	}
+
+	specs, err := handler(raw)
+	if err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if err := r.handlePodSpec(spec.spec, spec.path); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (r *AdmissionReview) handleStatefulsetV1Resource() error {
-	rawRequest := r.Request.Object.Raw
-	resource := appsv1.StatefulSet{}
-	if _, _, err := deserializer.Decode(rawRequest, nil, &resource); err != nil {
-		return NewApiError(http.StatusBadRequest, err.Error())
+// subtractImages returns the images of a missing from b, without
+// duplicates.
+func subtractImages(a []Image, b []Image) []Image {
+	var images []Image
+	for _, image := range a {
+		if !containsImage(b, image) && !containsImage(images, image) {
+			images = append(images, image)
+		}
 	}
-	return r.handlePodSpec(&resource.Spec.Template.Spec)
+	return images
 }
 
-func (r *AdmissionReview) handleReplicasetResource() error {
-	s := (r.Request.Kind.Version)
-	switch s {
-	case "v1":
-		return r.handleReplicasetV1Resource()
-	default:
-		return NewApiError(http.StatusNotImplemented, fmt.Sprintf("resource kind %s.%s, not implemented", s, r.Request.Kind.Kind))
+// sameRefs reports whether a and b reference the same set of images,
+// whatever containers they are in.
+func sameRefs(a []Container, b []Container) bool {
+	refsA, refsB := refsOf(a), refsOf(b)
+	if len(refsA) != len(refsB) {
+		return false
 	}
+	for ref := range refsA {
+		if !refsB[ref] {
+			return false
+		}
+	}
+	return true
 }
 
-func (r *AdmissionReview) handleReplicasetV1Resource() error {
-	rawRequest := r.Request.Object.Raw
-	resource := appsv1.ReplicaSet{}
-	if _, _, err := deserializer.Decode(rawRequest, nil, &resource); err != nil {
-		return NewApiError(http.StatusBadRequest, err.Error())
+func refsOf(containers []Container) map[string]bool {
+	refs := map[string]bool{}
+	for _, container := range containers {
+		refs[container.ref] = true
 	}
-	return r.handlePodSpec(&resource.Spec.Template.Spec)
+	return refs
 }
 
-func (r *AdmissionReview) handlePodSpec(spec *corev1.PodSpec) error {
-	for _, container := range spec.InitContainers {
-		r.images = append(r.images, NewImage(container.Image))
+func containsImage(images []Image, image Image) bool {
+	for _, i := range images {
+		if i == image {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePodSpec collects the images of a pod spec found at path, a JSON
+// pointer into the request object.
+func (r *AdmissionReview) handlePodSpec(spec *corev1.PodSpec, path string) error {
+	for i, container := range spec.InitContainers {
+		r.addContainer(container.Name, container.Image, fmt.Sprintf("%s/initContainers/%d/image", path, i))
+	}
+	for i, container := range spec.Containers {
+		r.addContainer(container.Name, container.Image, fmt.Sprintf("%s/containers/%d/image", path, i))
 	}
-	for _, container := range spec.Containers {
-		r.images = append(r.images, NewImage(container.Image))
+	// Ephemeral containers are added to running pods through the
+	// pods/ephemeralcontainers subresource, e.g. by kubectl debug.
+	for i, container := range spec.EphemeralContainers {
+		r.addContainer(container.Name, container.Image, fmt.Sprintf("%s/ephemeralContainers/%d/image", path, i))
 	}
 	return nil
 }
+
+func (r *AdmissionReview) addContainer(name string, ref string, path string) {
+	image, err := NewImage(ref)
+	container := Container{
+		name:  name,
+		path:  path,
+		ref:   ref,
+		image: image,
+		err:   err,
+	}
+	if err == nil {
+		r.images = append(r.images, image)
+	}
+	r.containers = append(r.containers, container)
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/imperialops/airgap-webhook/admission"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 )
 
 var (
@@ -184,6 +190,19 @@ spec:
       containers:
       - name: php-redis
         image: gcr.io/google_samples/gb-frontend:v3`)
+	v1PodDebug = []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: nginx-webserver
+  namespace: default
+spec:
+  containers:
+  - name: web
+    image: nginx:1.25
+  ephemeralContainers:
+  - name: debugger
+    image: busybox:1.28
+    targetContainerName: web`)
 )
 
 func TestHandleResource(t *testing.T) {
@@ -194,21 +213,21 @@ func TestHandleResource(t *testing.T) {
 		{v1Pod, []Image{
 			{
 				registry:   "docker.io",
-				repository: "busybox",
+				repository: "library/busybox",
 				tag:        "1.28",
 				digestHash: "",
 				digest:     "",
 			},
 			{
 				registry:   "docker.io",
-				repository: "nginx",
-				tag:        "latest",
+				repository: "library/nginx",
+				tag:        "",
 				digestHash: "sha256",
 				digest:     "f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1",
 			},
 			{
 				registry:   "docker.io",
-				repository: "nginx",
+				repository: "library/nginx",
 				tag:        "stable",
 				digestHash: "sha256",
 				digest:     "f3c37d8a26f7a7d8a547470c58733f270bcccb7e785da17af81ec41576170da8",
@@ -224,7 +243,7 @@ func TestHandleResource(t *testing.T) {
 		{v1Job, []Image{
 			{
 				registry:   "docker.io",
-				repository: "perl",
+				repository: "library/perl",
 				tag:        "5.34.0",
 				digestHash: "",
 				digest:     "",
@@ -233,7 +252,7 @@ func TestHandleResource(t *testing.T) {
 		{v1CronJob, []Image{
 			{
 				registry:   "docker.io",
-				repository: "busybox",
+				repository: "library/busybox",
 				tag:        "1.28",
 				digestHash: "",
 				digest:     "",
@@ -285,3 +304,190 @@ func TestHandleResource(t *testing.T) {
 		assert.Equal(t, admissionReview.images, test.expected, "got %v, expected %v", admissionReview.images, test.expected)
 	}
 }
+
+func TestHandleEphemeralContainers(t *testing.T) {
+	expected := []Container{
+		{name: "web", path: "/spec/containers/0/image", ref: "nginx:1.25", image: MustImage("nginx:1.25")},
+		{name: "debugger", path: "/spec/ephemeralContainers/0/image", ref: "busybox:1.28", image: MustImage("busybox:1.28")},
+	}
+
+	// Without an old object, which would be identical, the images count
+	// as changed.
+	admissionReview := MustAdmissionReview(newReview(t, v1PodDebug, withOperation("update"), withSubResource("ephemeralcontainers"), withOldObject(nil)))
+	assert.NoError(t, admissionReview.handleResource())
+	assert.Equal(t, expected, admissionReview.containers)
+
+	// Clusters before 1.22 send an EphemeralContainers object.
+	legacy := []byte(`{
+		"apiVersion": "v1",
+		"kind": "EphemeralContainers",
+		"metadata": {"name": "nginx-webserver", "namespace": "default"},
+		"ephemeralContainers": [{"name": "debugger", "image": "busybox:1.28"}]
+	}`)
+	admissionReview = MustAdmissionReview(newReview(t, v1PodDebug, withOperation("update"), withSubResource("ephemeralcontainers"), withOldObject(nil), withKind("EphemeralContainers"), withObject(legacy)))
+	assert.NoError(t, admissionReview.handleResource())
+	assert.Equal(t, []Container{
+		{name: "debugger", path: "/ephemeralContainers/0/image", ref: "busybox:1.28", image: MustImage("busybox:1.28")},
+	}, admissionReview.containers)
+
+	// Other subresources are ignored.
+	admissionReview = MustAdmissionReview(newReview(t, v1PodDebug, withOperation("update"), withSubResource("status"), withOldObject(nil)))
+	assert.NoError(t, admissionReview.handleResource())
+	assert.Empty(t, admissionReview.containers)
+}
+
+func TestHandleResourceOperations(t *testing.T) {
+	perl := MustImage("perl:5.34.0")
+	perlNew := MustImage("perl:5.36.0")
+	updated := []byte(`{"apiVersion": "batch/v1", "kind": "Job", "metadata": {"name": "pi"}, "spec": {"template": {"spec": {"containers": [{"name": "pi", "image": "perl:5.36.0"}]}}}}`)
+
+	admissionReview := MustAdmissionReview(newReview(t, v1Job, withOperation("update"), withObject(updated)))
+	assert.NoError(t, admissionReview.handleResource())
+	assert.Equal(t, []Image{perlNew}, admissionReview.images)
+	assert.Equal(t, []Image{perl}, admissionReview.oldImages)
+	report := admissionReview.Report()
+	assert.Equal(t, []Image{perlNew}, report.Added)
+	assert.Equal(t, []Image{perl}, report.Removed)
+
+	admissionReview = MustAdmissionReview(newReview(t, v1Job, withOperation("update")))
+	assert.NoError(t, admissionReview.handleResource())
+	report = admissionReview.Report()
+	assert.Equal(t, []Image{perl}, report.Images)
+	assert.Empty(t, report.Added)
+	assert.Empty(t, report.Removed)
+
+	admissionReview = MustAdmissionReview(newReview(t, v1Job, withOperation("delete")))
+	assert.NoError(t, admissionReview.handleResource())
+	assert.Empty(t, admissionReview.containers)
+	report = admissionReview.Report()
+	assert.Equal(t, "DELETE", report.Operation)
+	assert.Empty(t, report.Images)
+	assert.Equal(t, []Image{perl}, report.Removed)
+
+	// Deleting a workload is allowed whatever its images.
+	policy := NewPolicy(ConfigPolicy{
+		Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce, Allowed: []string{"mirror.internal"}},
+	}, nil, nil, nil)
+	admissionReview, err := handleAdmissionReview(newReview(t, v1Job, withOperation("delete")), nil, nil, policy)
+	assert.NoError(t, err)
+	assert.True(t, admissionReview.Response.Allowed)
+	admissionReview, err = handleAdmissionReview(newReview(t, v1Job, withOperation("update"), withObject(updated)), nil, nil, policy)
+	assert.NoError(t, err)
+	assert.False(t, admissionReview.Response.Allowed)
+}
+
+func TestHandleAdmissionReviewSkipsUnchanged(t *testing.T) {
+	policy := NewPolicy(ConfigPolicy{
+		Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce, Allowed: []string{"mirror.internal"}},
+	}, nil, nil, nil)
+	skipped := testutil.ToFloat64(reviewsSkipped.WithLabelValues("Job", skipReasonUnchanged))
+
+	// Scaling or relabeling keeps the images.
+	relabeled := []byte(`{"apiVersion": "batch/v1", "kind": "Job", "metadata": {"name": "pi", "labels": {"team": "math"}}, "spec": {"template": {"spec": {"containers": [{"name": "pi", "image": "perl:5.34.0"}]}}}}`)
+	admissionReview, err := handleAdmissionReview(newReview(t, v1Job, withOperation("update"), withObject(relabeled)), nil, nil, policy)
+	assert.NoError(t, err)
+	assert.True(t, admissionReview.skipped)
+	assert.True(t, admissionReview.Response.Allowed)
+	assert.Empty(t, admissionReview.violations)
+	assert.Equal(t, skipped+1, testutil.ToFloat64(reviewsSkipped.WithLabelValues("Job", skipReasonUnchanged)))
+
+	// Renaming a container keeps the images too.
+	renamed := []byte(`{"apiVersion": "batch/v1", "kind": "Job", "metadata": {"name": "pi"}, "spec": {"template": {"spec": {"containers": [{"name": "bpi", "image": "perl:5.34.0"}]}}}}`)
+	admissionReview, err = handleAdmissionReview(newReview(t, v1Job, withOperation("update"), withObject(renamed)), nil, nil, policy)
+	assert.NoError(t, err)
+	assert.True(t, admissionReview.skipped)
+
+	// Adding a container does not.
+	sidecar := []byte(`{"apiVersion": "batch/v1", "kind": "Job", "metadata": {"name": "pi"}, "spec": {"template": {"spec": {"containers": [{"name": "pi", "image": "perl:5.34.0"}, {"name": "proxy", "image": "envoyproxy/envoy:v1.26.1"}]}}}}`)
+	admissionReview, err = handleAdmissionReview(newReview(t, v1Job, withOperation("update"), withObject(sidecar)), nil, nil, policy)
+	assert.NoError(t, err)
+	assert.False(t, admissionReview.skipped)
+	assert.False(t, admissionReview.Response.Allowed)
+	assert.Equal(t, skipped+2, testutil.ToFloat64(reviewsSkipped.WithLabelValues("Job", skipReasonUnchanged)))
+
+	// Status updates are skipped for another reason.
+	status := testutil.ToFloat64(reviewsSkipped.WithLabelValues("Job", skipReasonSubresource))
+	admissionReview, err = handleAdmissionReview(newReview(t, v1Job, withOperation("update"), withSubResource("status"), withObject(sidecar)), nil, nil, policy)
+	assert.NoError(t, err)
+	assert.True(t, admissionReview.skipped)
+	assert.Equal(t, status+1, testutil.ToFloat64(reviewsSkipped.WithLabelValues("Job", skipReasonSubresource)))
+	assert.Equal(t, skipped+2, testutil.ToFloat64(reviewsSkipped.WithLabelValues("Job", skipReasonUnchanged)))
+
+	backend := &fakeBackend{}
+	s := &ApiServerCommon{config: &Config{}, backend: backend}
+	r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(newReview(t, v1Job, withOperation("update"), withObject(relabeled))))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.newServeMux().ServeHTTP(w, r)
+	assert.True(t, decodeResponse(t, w.Body.Bytes()).Allowed)
+	assert.Empty(t, backend.Reports(), "unchanged images must not be reported")
+
+	r = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w = httptest.NewRecorder()
+	s.newServeMux().ServeHTTP(w, r)
+	assert.Contains(t, w.Body.String(), `airgap_webhook_reviews_skipped_total{kind="Job",reason="unchanged_images"}`)
+}
+
+func TestAdmissionReviewVersions(t *testing.T) {
+	v1, err := admission.CreateAdmissionReviewRequest(v1Pod, "create", "imperialops", []string{})
+	assert.NoError(t, err)
+
+	tests := []struct {
+		body       []byte
+		apiVersion string
+	}{
+		{v1, "admission.k8s.io/v1"},
+		{newReview(t, v1Pod, withVersion(admissionv1beta1.SchemeGroupVersion.String())), "admission.k8s.io/v1beta1"},
+	}
+
+	s := &ApiServerCommon{
+		config: &Config{},
+		policy: NewPolicy(ConfigPolicy{
+			Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce, Allowed: []string{"docker.io", "ghcr.io"}},
+		}, nil, nil, nil),
+		mutator: &Mutator{mirror: testMirror(t, "docker.io=mirror.internal/docker.io")},
+	}
+	for _, test := range tests {
+		admissionReview := MustAdmissionReview(test.body)
+		assert.Equal(t, test.apiVersion, admissionReview.version.String())
+		assert.NoError(t, admissionReview.handleResource())
+		assert.Len(t, admissionReview.containers, 4, test.apiVersion)
+
+		for _, path := range []string{"/validate", "/mutate"} {
+			r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(test.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			s.newServeMux().ServeHTTP(w, r)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			// Both versions share the same wire format apart from the
+			// apiVersion.
+			review := admissionv1beta1.AdmissionReview{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &review))
+			assert.Equal(t, test.apiVersion, review.APIVersion, path)
+			assert.Equal(t, "AdmissionReview", review.Kind, path)
+			assert.Equal(t, admissionReview.Request.UID, review.Response.UID, path)
+			assert.True(t, review.Response.Allowed, path)
+			if path == "/mutate" {
+				assert.Equal(t, admissionv1beta1.PatchTypeJSONPatch, *review.Response.PatchType)
+				assert.NotEmpty(t, review.Response.Patch)
+			}
+		}
+	}
+
+	w := postValidate(t, s, v1Pod)
+	assert.Contains(t, w.Body.String(), `"apiVersion":"admission.k8s.io/v1"`)
+
+	// Failures are answered in the version of the request too.
+	body := newReview(t, v1Pod, withVersion(admissionv1beta1.SchemeGroupVersion.String()))
+	body = bytes.Replace(body, []byte(`"containers":[`), []byte(`"containers":"nginx","x":[`), 1)
+	r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	s.newServeMux().ServeHTTP(w, r)
+	review := admissionv1beta1.AdmissionReview{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &review))
+	assert.Equal(t, "admission.k8s.io/v1beta1", review.APIVersion)
+	assert.False(t, review.Response.Allowed)
+	assert.Equal(t, int32(http.StatusBadRequest), review.Response.Result.Code)
+}
@@ -1,84 +1,291 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type apiFunc func(w http.ResponseWriter, r *http.Request) error
 
+const (
+	// defaultAdmissionTimeout is the webhook timeout of the api server
+	// when the request does not carry one.
+	defaultAdmissionTimeout = 10 * time.Second
+	// admissionTimeoutMargin is kept from the webhook timeout to answer
+	// the review after sending its report failed.
+	admissionTimeoutMargin = 500 * time.Millisecond
+)
+
 type ApiServer interface {
-	Run()
+	Run(ctx context.Context) error
+	Reload(c *Config) error
 }
 
 type ApiServerCommon struct {
-	config  *Config
-	backend IBackend
+	config    *Config
+	backend   IBackend
+	inventory IInventory
+	// mu guards the policy, mutator, rules and scope, which are swapped
+	// when the config is reloaded.
+	mu      sync.RWMutex
+	policy  *Policy
+	mutator *Mutator
+	rules   ResourceRules
+	scope   *Scope
+	// namespaceLabels is started on the first config with a namespace
+	// selector and kept across reloads.
+	namespaceLabels INamespaceLabels
+	// stop ends the watches of the kubernetes api.
+	stop chan struct{}
+	// inFlight counts the requests being handled, they may outlive the
+	// drain of the servers.
+	inFlight atomic.Int64
 }
 
 type ApiServerHttp struct {
-	ApiServerCommon
+	*ApiServerCommon
 }
 
 type ApiServerHttps struct {
-	ApiServerCommon
+	*ApiServerCommon
 }
 
-func NewApiServer(c *Config) ApiServer {
-	apiServer := ApiServerCommon{
-		config:  c,
-		backend: NewBackend(c.backend),
+func NewApiServer(c *Config) (ApiServer, error) {
+	backend, err := NewBackend(c.Backend)
+	if err != nil {
+		return nil, err
 	}
 
-	switch c.tls.enabled {
+	apiServer := &ApiServerCommon{
+		config:    c,
+		backend:   backend,
+		inventory: inventoryOf(backend),
+		stop:      make(chan struct{}),
+	}
+	if err := apiServer.Reload(c); err != nil {
+		return nil, err
+	}
+
+	switch c.Tls.Enabled {
 	case true:
 		return &ApiServerHttps{
 			ApiServerCommon: apiServer,
-		}
+		}, nil
 	default:
 		return &ApiServerHttp{
 			ApiServerCommon: apiServer,
+		}, nil
+	}
+}
+
+// Reload applies the policy, scope, registry mirrors, digest catalog and
+// resource rules of c. Nothing is applied unless all of them are valid.
+// Listeners, tls and backend settings only change on restart.
+func (s *ApiServerCommon) Reload(c *Config) error {
+	catalog, err := NewDigestCatalog(c.Digest, c.Mirror)
+	if err != nil {
+		return err
+	}
+
+	rules, err := NewResourceRules(c.Resources)
+	if err != nil {
+		return err
+	}
+
+	if c.Scope.NamespaceSelector != "" && s.namespaceLabels == nil {
+		client, err := NewKubeClient()
+		if err != nil {
+			return err
 		}
+		s.namespaceLabels = NewNamespaceInformer(client, s.stop)
 	}
+	if informer, ok := s.namespaceLabels.(*NamespaceInformer); ok && c.Scope.NamespaceSelector != "" {
+		if err := informer.WaitForSync(namespaceSyncTimeout); err != nil {
+			return err
+		}
+	}
+	scope, err := NewScope(c.Scope, s.namespaceLabels)
+	if err != nil {
+		return err
+	}
+
+	if s.config.ListenAddr != c.ListenAddr || s.config.ApiAddr != c.ApiAddr || s.config.Tls != c.Tls || s.config.Bootstrap != c.Bootstrap || !reflect.DeepEqual(s.config.Backend, c.Backend) {
+		log.Printf("listener, tls, bootstrap and backend changes are applied on restart")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = NewPolicy(c.Policy, catalog, s.inventory, syncInventoryOf(s.backend))
+	s.mutator = NewMutator(c, catalog)
+	s.rules = rules
+	s.scope = scope
+	return nil
+}
+
+// current returns the settings in effect for a request.
+func (s *ApiServerCommon) current() (ResourceRules, *Scope, *Policy, *Mutator) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rules, s.scope, s.policy, s.mutator
 }
 
-func (s *ApiServerHttps) Run() {
-	cert, err := tls.LoadX509KeyPair(s.config.tls.certFile, s.config.tls.keyFile)
+func (s *ApiServerHttps) Run(ctx context.Context) error {
+	certs, err := NewCertWatcher(s.config.Tls.CertFile, s.config.Tls.KeyFile)
 	if err != nil {
-		log.Println("Unable to load cert or key file")
-		panic(err)
+		return fmt.Errorf("unable to load cert or key file: %w", err)
 	}
+	defer certs.Close()
 
-	log.Printf("listening on %s", s.config.listenAddr)
-	http.HandleFunc("/healthz", newApiFunc(s.handleHealth))
-	http.HandleFunc("/validate", newApiFunc(s.handleValidate))
-	server := http.Server{
-		Addr: s.config.listenAddr,
+	server := &http.Server{
+		Addr:    s.config.ListenAddr,
+		Handler: s.track(s.newServeMux()),
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: certs.GetCertificate,
 		},
 	}
+	return s.serve(ctx, server, func() error {
+		return server.ListenAndServeTLS("", "")
+	})
+}
+
+func (s *ApiServerHttp) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:    s.config.ListenAddr,
+		Handler: s.track(s.newServeMux()),
+	}
+	return s.serve(ctx, server, server.ListenAndServe)
+}
+
+// serve runs the webhook server, and the api server when an api address
+// is configured, until ctx ends or a listener fails. The servers then
+// stop accepting connections and in-flight requests are given half of
+// the shutdown timeout to finish, queued reports the rest of it.
+//
+// Requests still running when the drain times out are waited for before
+// the backend is closed. If they outlive the shutdown timeout as well,
+// the backend is left open and queued reports are only kept in the
+// write-ahead log, if any.
+func (s *ApiServerCommon) serve(ctx context.Context, server *http.Server, listen func() error) error {
+	servers := []*http.Server{server}
+	errs := make(chan error, 2)
+	log.Printf("listening on %s", s.config.ListenAddr)
+	go func() {
+		errs <- listen()
+	}()
+	if api := s.newApiServer(); api != nil {
+		servers = append(servers, api)
+		log.Printf("api listening on %s", s.config.ApiAddr)
+		go func() {
+			errs <- api.ListenAndServe()
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Printf("shutting down, waiting up to %s for requests to finish", s.config.ShutdownTimeout)
+	case err = <-errs:
+		log.Printf("server failed, shutting down: %s", err)
+	}
 
-	if err := server.ListenAndServeTLS("", ""); err != nil {
-		panic(err)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	drainCtx, cancelDrain := context.WithTimeout(shutdownCtx, s.config.ShutdownTimeout/2)
+	defer cancelDrain()
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(drainCtx); shutdownErr != nil {
+			err = errors.Join(err, fmt.Errorf("unable to drain requests on %s: %w", server.Addr, shutdownErr))
+		}
+	}
+	if waitErr := s.waitRequests(shutdownCtx); waitErr != nil {
+		return errors.Join(err, waitErr)
 	}
+	return errors.Join(err, s.shutdown(shutdownCtx))
+}
+
+// track counts the requests handled by h.
+func (s *ApiServerCommon) track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+		h.ServeHTTP(w, r)
+	})
 }
 
-func (s *ApiServerHttp) Run() {
-	log.Printf("listening on %s", s.config.listenAddr)
-	http.HandleFunc("/healthz", newApiFunc(s.handleHealth))
-	http.HandleFunc("/validate", newApiFunc(s.handleValidate))
-	server := http.Server{
-		Addr: s.config.listenAddr,
+// waitRequests waits until no request is being handled or ctx ends.
+func (s *ApiServerCommon) waitRequests(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		n := s.inFlight.Load()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d requests still running, backend left open: %w", n, ctx.Err())
+		case <-ticker.C:
+		}
 	}
+}
+
+// shutdown stops the watches of the kubernetes api, delivers the reports
+// still queued for the backend and closes it.
+func (s *ApiServerCommon) shutdown(ctx context.Context) error {
+	close(s.stop)
 
-	if err := server.ListenAndServe(); err != nil {
-		panic(err)
+	var err error
+	backend := s.backend
+	if queue, ok := backend.(*Queue); ok {
+		err = queue.Shutdown(ctx)
+		backend = queue.Unwrap()
+	}
+	if closer, ok := backend.(io.Closer); ok {
+		err = errors.Join(err, closer.Close())
+	}
+	return err
+}
+
+// newServeMux serves the admission webhook. The api server must be able to
+// reach it, so the inventory is never served on it.
+func (s *ApiServerCommon) newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", newApiFunc(s.handleHealth))
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/validate", newApiFunc(s.handleValidate))
+	mux.HandleFunc("/mutate", newApiFunc(s.handleMutate))
+	return mux
+}
+
+// newApiServeMux serves the inventory api, which is not authenticated.
+func (s *ApiServerCommon) newApiServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", newApiFunc(s.handleHealth))
+	mux.Handle("/metrics", metricsHandler())
+	s.registerInventoryRoutes(mux)
+	return mux
+}
+
+// newApiServer returns the plain http server of the inventory api, or nil
+// when the inventory api is disabled.
+func (s *ApiServerCommon) newApiServer() *http.Server {
+	if s.config.ApiAddr == "" {
+		return nil
+	}
+	return &http.Server{
+		Addr:    s.config.ApiAddr,
+		Handler: s.track(s.newApiServeMux()),
 	}
 }
 
@@ -105,9 +312,89 @@ func (s *ApiServerCommon) handleValidate(w http.ResponseWriter, r *http.Request)
 }
 
 func (s *ApiServerCommon) handlePostValidate(w http.ResponseWriter, r *http.Request) error {
+	body, err := readAdmissionReview(r)
+	if err != nil {
+		return s.writeFailureReview(w, body, err)
+	}
+
+	rules, scope, policy, _ := s.current()
+	admissionReview, err := handleAdmissionReview(body, rules, scope, policy)
+	if err != nil {
+		return s.writeFailureReview(w, body, err)
+	}
+
+	if s.backend != nil && admissionReview.Reportable() {
+		if err := s.send(r, []Report{admissionReview.Report()}); err != nil {
+			log.Printf("unable to report images for %s: %s", admissionReview.Request.UID, err)
+			return s.writeFailureReview(w, body, NewApiError(http.StatusInternalServerError, "unable to store image report"))
+		}
+	}
+
+	return writeJson(w, http.StatusOK, admissionReview.Reply())
+}
+
+// send delivers reports while the admission request is handled. Sends to
+// a backend that supports it stop short of the timeout the api server
+// gives the webhook, so the review is still answered in time.
+func (s *ApiServerCommon) send(r *http.Request, reports []Report) error {
+	backend, ok := s.backend.(IContextBackend)
+	if !ok {
+		return s.backend.Send(reports)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), admissionTimeout(r)-admissionTimeoutMargin)
+	defer cancel()
+	return backend.SendContext(ctx, reports)
+}
+
+// admissionTimeout returns the timeout the api server passes in the
+// timeout query parameter, or its default webhook timeout.
+func admissionTimeout(r *http.Request) time.Duration {
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+	if err != nil || timeout <= admissionTimeoutMargin {
+		return defaultAdmissionTimeout
+	}
+	return timeout
+}
+
+func (s *ApiServerCommon) handleMutate(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "POST":
+		return s.handlePostMutate(w, r)
+	default:
+		return NewApiError(http.StatusMethodNotAllowed, fmt.Sprintf("%s method not allowed", r.Method))
+	}
+}
+
+func (s *ApiServerCommon) handlePostMutate(w http.ResponseWriter, r *http.Request) error {
+	body, err := readAdmissionReview(r)
+	if err != nil {
+		return s.writeFailureReview(w, body, err)
+	}
+
+	rules, scope, _, mutator := s.current()
+	admissionReview, err := handleMutationReview(body, rules, scope, mutator)
+	if err != nil {
+		return s.writeFailureReview(w, body, err)
+	}
+
+	return writeJson(w, http.StatusOK, admissionReview.Reply())
+}
+
+// writeFailureReview answers an admission request that could not be
+// processed with a review the api server understands, allowed or denied
+// according to the failure policy.
+func (s *ApiServerCommon) writeFailureReview(w http.ResponseWriter, body []byte, err error) error {
+	_, _, policy, _ := s.current()
+	admissionReview := newFailureReview(body, policy.FailureResponse(err))
+	log.Printf("unable to process admission request %s: %s", admissionReview.Request.UID, err)
+	return writeJson(w, http.StatusOK, admissionReview.Reply())
+}
+
+// readAdmissionReview returns the body of an admission request.
+func readAdmissionReview(r *http.Request) ([]byte, error) {
 	// Validate that the incoming content type is correct.
 	if r.Header.Get("Content-Type") != "application/json" {
-		return NewApiError(http.StatusBadRequest, "expected application/json content-type")
+		return nil, NewApiError(http.StatusBadRequest, "expected application/json content-type")
 	}
 
 	// Get the body data, which will be the AdmissionReview
@@ -116,17 +403,11 @@ func (s *ApiServerCommon) handlePostValidate(w http.ResponseWriter, r *http.Requ
 	if r.Body != nil {
 		requestData, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			return NewApiError(http.StatusBadRequest, "expected a request body")
+			return nil, NewApiError(http.StatusBadRequest, "expected a request body")
 		}
 		body = requestData
 	}
-
-	response, err := handleAdmissionReview(body)
-	if err != nil {
-		return err
-	}
-
-	return writeJson(w, http.StatusOK, response)
+	return body, nil
 }
 
 func (s *ApiServerCommon) handleHealth(w http.ResponseWriter, r *http.Request) error {
@@ -147,12 +428,17 @@ func (s *ApiServerCommon) handleGetHealth(w http.ResponseWriter, r *http.Request
 }
 
 func (s *ApiServerCommon) isServerHealthy() bool {
-	// TODO check DB connection
+	if h, ok := s.backend.(IHealthCheck); ok {
+		if err := h.Healthy(); err != nil {
+			log.Printf("backend is unhealthy: %s", err)
+			return false
+		}
+	}
 	return true
 }
 
 func writeJson(w http.ResponseWriter, code int, v any) error {
-	w.WriteHeader(code)
 	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(code)
 	return json.NewEncoder(w).Encode(v)
 }
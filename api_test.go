@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/imperialops/airgap-webhook/admission"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+type fakeBackend struct {
+	mu      sync.Mutex
+	err     error
+	reports []Report
+}
+
+func (b *fakeBackend) Send(reports []Report) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.reports = append(b.reports, reports...)
+	return nil
+}
+
+func (b *fakeBackend) Reports() []Report {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Report{}, b.reports...)
+}
+
+// reviewOptions describe the admission review built by newReview.
+type reviewOptions struct {
+	action      string
+	user        string
+	groups      []string
+	dryRun      bool
+	subResource string
+	kind        string
+	apiVersion  string
+	object      []byte
+	oldObject   []byte
+	setObject   bool
+	setOld      bool
+}
+
+type reviewOption func(*reviewOptions)
+
+// withOperation sets the action, create, update, delete or connect. The
+// old object of an update is the object itself unless given.
+func withOperation(action string) reviewOption {
+	return func(o *reviewOptions) { o.action = action }
+}
+
+func withUser(user string, groups ...string) reviewOption {
+	return func(o *reviewOptions) { o.user, o.groups = user, groups }
+}
+
+func withDryRun(dryRun bool) reviewOption {
+	return func(o *reviewOptions) { o.dryRun = dryRun }
+}
+
+func withSubResource(subResource string) reviewOption {
+	return func(o *reviewOptions) { o.subResource = subResource }
+}
+
+func withKind(kind string) reviewOption {
+	return func(o *reviewOptions) { o.kind = kind }
+}
+
+// withVersion sets the apiVersion of the review, such as
+// admission.k8s.io/v1beta1.
+func withVersion(apiVersion string) reviewOption {
+	return func(o *reviewOptions) { o.apiVersion = apiVersion }
+}
+
+// withObject replaces the object of the review with a YAML or JSON one.
+func withObject(object []byte) reviewOption {
+	return func(o *reviewOptions) { o.object, o.setObject = object, true }
+}
+
+// withOldObject replaces the old object of the review, nil removes it.
+func withOldObject(old []byte) reviewOption {
+	return func(o *reviewOptions) { o.oldObject, o.setOld = old, true }
+}
+
+// newReview returns an admission review of resource, by default a CREATE
+// by imperialops that is not a dry run.
+func newReview(t *testing.T, resource []byte, options ...reviewOption) []byte {
+	o := reviewOptions{action: "create", user: "imperialops", groups: []string{}}
+	for _, option := range options {
+		option(&o)
+	}
+
+	body, err := admission.CreateAdmissionReviewRequest(resource, o.action, o.user, o.groups)
+	assert.NoError(t, err)
+	review := admissionv1.AdmissionReview{}
+	assert.NoError(t, json.Unmarshal(body, &review))
+
+	review.Request.DryRun = &o.dryRun
+	if o.subResource != "" {
+		review.Request.SubResource = o.subResource
+		review.Request.RequestSubResource = o.subResource
+	}
+	if o.kind != "" {
+		review.Request.Kind.Kind = o.kind
+	}
+	if o.apiVersion != "" {
+		review.APIVersion = o.apiVersion
+	}
+	if o.setObject {
+		review.Request.Object = rawObject(t, o.object)
+	}
+	if o.setOld {
+		review.Request.OldObject = rawObject(t, o.oldObject)
+	}
+
+	body, err = json.Marshal(review)
+	assert.NoError(t, err)
+	return body
+}
+
+func rawObject(t *testing.T, object []byte) runtime.RawExtension {
+	if object == nil {
+		return runtime.RawExtension{}
+	}
+	raw, err := yaml.YAMLToJSON(object)
+	assert.NoError(t, err)
+	return runtime.RawExtension{Raw: raw}
+}
+
+func postValidate(t *testing.T, s *ApiServerCommon, resource []byte) *httptest.ResponseRecorder {
+	return postValidateReview(t, s, newReview(t, resource))
+}
+
+func postValidateReview(t *testing.T, s *ApiServerCommon, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	newApiFunc(s.handleValidate)(w, r)
+	return w
+}
+
+func TestHandlePostValidateReports(t *testing.T) {
+	backend := &fakeBackend{}
+	s := &ApiServerCommon{config: &Config{}, backend: backend}
+
+	w := postValidate(t, s, v1Job)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []Report{{
+		Kind:      "Job",
+		Name:      "pi",
+		Operation: "CREATE",
+		Images:    []Image{MustImage("perl:5.34.0")},
+		Added:     []Image{MustImage("perl:5.34.0")},
+	}}, backend.Reports())
+}
+
+func TestHandlePostValidateDryRun(t *testing.T) {
+	tests := []struct {
+		name   string
+		dryRun bool
+		async  bool
+		sent   int
+	}{
+		{"sync", false, false, 1},
+		{"sync dry run", true, false, 0},
+		{"async", false, true, 1},
+		{"async dry run", true, true, 0},
+	}
+
+	for _, test := range tests {
+		backend := &fakeBackend{}
+		s := &ApiServerCommon{config: &Config{}, backend: backend}
+		var queue *Queue
+		if test.async {
+			var err error
+			queue, err = NewQueue(backend, testQueueConfig(""))
+			assert.NoError(t, err)
+			s.backend = queue
+		}
+
+		w := postValidateReview(t, s, newReview(t, v1Job, withDryRun(test.dryRun)))
+		assert.True(t, decodeResponse(t, w.Body.Bytes()).Allowed, test.name)
+		if queue != nil {
+			assert.NoError(t, queue.Shutdown(context.Background()), test.name)
+		}
+		assert.Len(t, backend.Reports(), test.sent, test.name)
+	}
+}
+
+func TestHandlePostValidateSyncFailure(t *testing.T) {
+	backend := &fakeBackend{err: errors.New("unavailable")}
+	s := &ApiServerCommon{config: &Config{}, backend: backend}
+
+	w := postValidate(t, s, v1Job)
+	assert.Equal(t, http.StatusOK, w.Code)
+	response := decodeResponse(t, w.Body.Bytes())
+	assert.False(t, response.Allowed)
+	assert.NotEmpty(t, response.UID)
+	assert.Equal(t, int32(http.StatusInternalServerError), response.Result.Code)
+	assert.Equal(t, "unable to store image report", response.Result.Message)
+}
+
+func TestHandlePostValidateFailurePolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int32
+		reason      metav1.StatusReason
+		uid         bool
+	}{
+		{"content type", "text/plain", `{}`, http.StatusBadRequest, metav1.StatusReasonBadRequest, false},
+		{"invalid json", "application/json", `{"request": `, http.StatusBadRequest, metav1.StatusReasonBadRequest, false},
+		{"invalid object", "application/json", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "7a1c", "kind": {"version": "v1", "kind": "Pod"}, "object": {"spec": {"containers": "nginx"}}}}`, http.StatusBadRequest, metav1.StatusReasonBadRequest, true},
+	}
+
+	for _, failure := range []string{FailurePolicyFail, FailurePolicyIgnore} {
+		s := &ApiServerCommon{
+			config: &Config{},
+			policy: NewPolicy(ConfigPolicy{Failure: failure}, nil, nil, nil),
+		}
+		for _, test := range tests {
+			for _, path := range []string{"/validate", "/mutate"} {
+				r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(test.body)))
+				r.Header.Set("Content-Type", test.contentType)
+				w := httptest.NewRecorder()
+				s.newServeMux().ServeHTTP(w, r)
+				assert.Equal(t, http.StatusOK, w.Code, test.name)
+
+				review := admissionv1.AdmissionReview{}
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &review), test.name)
+				assert.Equal(t, "admission.k8s.io/v1", review.APIVersion, test.name)
+				assert.Equal(t, "AdmissionReview", review.Kind, test.name)
+				assert.Equal(t, failure == FailurePolicyIgnore, review.Response.Allowed, test.name)
+				assert.Equal(t, test.code, review.Response.Result.Code, test.name)
+				assert.Equal(t, test.reason, review.Response.Result.Reason, test.name)
+				assert.NotEmpty(t, review.Response.Result.Message, test.name)
+				if test.uid {
+					assert.Equal(t, "7a1c", string(review.Response.UID), test.name)
+				}
+			}
+		}
+	}
+}
+
+func TestHandlePostValidateAsync(t *testing.T) {
+	backend := &fakeBackend{}
+	queue, err := NewQueue(backend, testQueueConfig(""))
+	assert.NoError(t, err)
+	defer queue.Close()
+	s := &ApiServerCommon{config: &Config{}, backend: queue}
+
+	w := postValidate(t, s, v1Deployment)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Eventually(t, func() bool {
+		return len(backend.Reports()) == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestApiServerReload(t *testing.T) {
+	s := &ApiServerCommon{config: &Config{}}
+	config := &Config{Policy: ConfigPolicy{
+		Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce, Allowed: []string{"mirror.internal"}},
+		Failure:    FailurePolicyFail,
+	}}
+	assert.NoError(t, s.Reload(config))
+	assert.False(t, decodeResponse(t, postValidate(t, s, v1Job).Body.Bytes()).Allowed)
+
+	config.Policy.Registries.Allowed = append(config.Policy.Registries.Allowed, "docker.io")
+	config.Mirror.Rules = []ConfigMirrorRule{{From: "docker.io", To: "mirror.internal/docker.io"}}
+	assert.NoError(t, s.Reload(config))
+	assert.True(t, decodeResponse(t, postValidate(t, s, v1Job).Body.Bytes()).Allowed)
+	assert.NotEmpty(t, postMutate(t, s, v1Job).Patch)
+
+	// Invalid configs leave the running one in place.
+	invalid := *config
+	invalid.Policy.Registries.Allowed = nil
+	invalid.Scope.ObjectSelector = "app in (web"
+	assert.Error(t, s.Reload(&invalid))
+	assert.True(t, decodeResponse(t, postValidate(t, s, v1Job).Body.Bytes()).Allowed)
+}
+
+type signalBackend struct {
+	sent    chan struct{}
+	release chan struct{}
+	fakeBackend
+}
+
+func (b *signalBackend) Send(reports []Report) error {
+	b.sent <- struct{}{}
+	<-b.release
+	return b.fakeBackend.Send(reports)
+}
+
+func TestApiServerShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+
+	backend := &signalBackend{sent: make(chan struct{}), release: make(chan struct{})}
+	s := &ApiServerHttp{&ApiServerCommon{
+		config:  &Config{ListenAddr: addr, ShutdownTimeout: 5 * time.Second},
+		backend: backend,
+		stop:    make(chan struct{}),
+	}}
+	// Idle keep-alive connections would only delay the shutdown.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		resp, err := client.Get("http://" + addr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A review in flight when the server is stopped is answered.
+	responses := make(chan *http.Response)
+	go func() {
+		resp, err := client.Post("http://"+addr+"/validate", "application/json", bytes.NewReader(newReview(t, v1Job)))
+		assert.NoError(t, err)
+		responses <- resp
+	}()
+	<-backend.sent
+	cancel()
+	select {
+	case <-done:
+		t.Fatal("server stopped before the request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(backend.release)
+
+	resp := <-responses
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, <-done)
+	assert.Len(t, backend.Reports(), 1)
+
+	_, err = client.Get("http://" + addr + "/healthz")
+	assert.Error(t, err, "new connections are refused")
+}
+
+type closingBackend struct {
+	signalBackend
+	closed         bool
+	sentAfterClose bool
+}
+
+func (b *closingBackend) Send(reports []Report) error {
+	b.sent <- struct{}{}
+	<-b.release
+	b.mu.Lock()
+	b.sentAfterClose = b.closed
+	b.mu.Unlock()
+	return b.fakeBackend.Send(reports)
+}
+
+func (b *closingBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
+
+func TestApiServerShutdownSlowRequest(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+
+	backend := &closingBackend{signalBackend: signalBackend{sent: make(chan struct{}), release: make(chan struct{})}}
+	s := &ApiServerHttp{&ApiServerCommon{
+		config:  &Config{ListenAddr: addr, ShutdownTimeout: 2 * time.Second},
+		backend: backend,
+		stop:    make(chan struct{}),
+	}}
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		resp, err := client.Get("http://" + addr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The review outlives the drain, the backend is closed once it is done.
+	responses := make(chan *http.Response)
+	go func() {
+		resp, err := client.Post("http://"+addr+"/validate", "application/json", bytes.NewReader(newReview(t, v1Job)))
+		assert.NoError(t, err)
+		responses <- resp
+	}()
+	<-backend.sent
+	cancel()
+	time.Sleep(1500 * time.Millisecond)
+	close(backend.release)
+
+	resp := <-responses
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.ErrorIs(t, <-done, context.DeadlineExceeded, "the drain timed out")
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	assert.False(t, backend.sentAfterClose)
+	assert.True(t, backend.closed)
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// bootstrapCaValidity and bootstrapCertValidity are the lifetimes of
+	// the generated certificates, the serving certificate is regenerated
+	// on startup once less than bootstrapRenewBefore is left.
+	bootstrapCaValidity   = 10 * 365 * 24 * time.Hour
+	bootstrapCertValidity = 365 * 24 * time.Hour
+	bootstrapRenewBefore  = 30 * 24 * time.Hour
+
+	// bootstrapCaCertKey and bootstrapCaKeyKey hold the ca in the Secret.
+	bootstrapCaCertKey = "ca.crt"
+	bootstrapCaKeyKey  = "ca.key"
+
+	// namespaceNameLabel is set on every namespace by the api server.
+	namespaceNameLabel = "kubernetes.io/metadata.name"
+)
+
+// Bootstrap provisions the serving certificate of the webhook in a Secret,
+// writes it to the tls cert and key files, and registers the validating
+// and mutating webhook configurations with its ca bundle.
+func Bootstrap(ctx context.Context, client kubernetes.Interface, c *Config) error {
+	secret, err := bootstrapSecret(ctx, client, c.Bootstrap)
+	if err != nil {
+		return fmt.Errorf("unable to provision tls secret: %w", err)
+	}
+
+	for file, key := range map[string]string{c.Tls.CertFile: corev1.TLSCertKey, c.Tls.KeyFile: corev1.TLSPrivateKeyKey} {
+		if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, secret.Data[key], 0o600); err != nil {
+			return err
+		}
+	}
+
+	if err := registerWebhooks(ctx, client, c, secret.Data[bootstrapCaCertKey]); err != nil {
+		return fmt.Errorf("unable to register webhooks: %w", err)
+	}
+	return nil
+}
+
+// bootstrapSecret returns the tls Secret of the webhook, issuing a new
+// serving certificate when it is missing, invalid or about to expire. The
+// ca of the Secret is kept so replicas still serving the previous
+// certificate are trusted, a new one is only generated when it is missing
+// or would expire before the serving certificate.
+func bootstrapSecret(ctx context.Context, client kubernetes.Interface, b ConfigBootstrap) (*corev1.Secret, error) {
+	secrets := client.CoreV1().Secrets(b.Namespace)
+	secret, err := secrets.Get(ctx, b.Secret, metav1.GetOptions{})
+	exists := !errors.IsNotFound(err)
+	if err != nil && exists {
+		return nil, err
+	}
+	if exists && validBootstrapSecret(secret, b) {
+		return secret, nil
+	}
+
+	var ca *x509.Certificate
+	var caKey *ecdsa.PrivateKey
+	if exists {
+		ca, caKey = bootstrapCa(secret)
+	}
+	if ca == nil {
+		if ca, caKey, err = newBootstrapCa(b); err != nil {
+			return nil, err
+		}
+	}
+	data, err := newBootstrapKeyPair(b, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: b.Secret, Namespace: b.Namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data:       data,
+		}
+		created, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+		// Another replica created it first, its certificate is used.
+		if errors.IsAlreadyExists(err) {
+			return secrets.Get(ctx, b.Secret, metav1.GetOptions{})
+		}
+		if err == nil {
+			log.Printf("created tls secret %s/%s", b.Namespace, b.Secret)
+		}
+		return created, err
+	}
+
+	secret.Data = data
+	updated, err := secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	// Another replica renewed it first, its certificate is used.
+	if errors.IsConflict(err) {
+		return secrets.Get(ctx, b.Secret, metav1.GetOptions{})
+	}
+	if err == nil {
+		log.Printf("renewed tls secret %s/%s", b.Namespace, b.Secret)
+	}
+	return updated, err
+}
+
+// validBootstrapSecret checks the serving certificate of secret is signed
+// by its ca, names the service and is not about to expire.
+func validBootstrapSecret(secret *corev1.Secret, b ConfigBootstrap) bool {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(secret.Data[bootstrapCaCertKey]) {
+		return false
+	}
+	block, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+	if block == nil {
+		return false
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		DNSName:     bootstrapDNSNames(b)[0],
+		Roots:       roots,
+		CurrentTime: time.Now().Add(bootstrapRenewBefore),
+	})
+	return err == nil && len(secret.Data[corev1.TLSPrivateKeyKey]) > 0
+}
+
+// bootstrapDNSNames are the names the api server may use to reach the
+// service, the fully qualified one first.
+func bootstrapDNSNames(b ConfigBootstrap) []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc", b.Service, b.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", b.Service, b.Namespace),
+		fmt.Sprintf("%s.%s", b.Service, b.Namespace),
+		b.Service,
+	}
+}
+
+// bootstrapCa returns the ca of secret and its key, or nil when either
+// is missing or the ca expires before a new serving certificate would.
+func bootstrapCa(secret *corev1.Secret) (*x509.Certificate, *ecdsa.PrivateKey) {
+	certBlock, _ := pem.Decode(secret.Data[bootstrapCaCertKey])
+	keyBlock, _ := pem.Decode(secret.Data[bootstrapCaKeyKey])
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil
+	}
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil || !ca.IsCA || ca.NotAfter.Before(time.Now().Add(bootstrapCertValidity)) {
+		return nil, nil
+	}
+	caKey, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil || !caKey.PublicKey.Equal(ca.PublicKey) {
+		return nil, nil
+	}
+	return ca, caKey
+}
+
+// newBootstrapCa generates a self signed ca for the serving certificates.
+func newBootstrapCa(b ConfigBootstrap) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	now := time.Now()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: b.Service + "-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(bootstrapCaValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("generated tls ca %s", template.Subject.CommonName)
+	return ca, caKey, nil
+}
+
+// newBootstrapKeyPair issues a serving certificate signed by ca, keyed
+// like a kubernetes.io/tls Secret plus ca.crt and ca.key.
+func newBootstrapKeyPair(b ConfigBootstrap, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (map[string][]byte, error) {
+	now := time.Now()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	names := bootstrapDNSNames(b)
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(bootstrapCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	caKeyDer, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{
+		bootstrapCaCertKey:      pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}),
+		bootstrapCaKeyKey:       pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: caKeyDer}),
+		corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}, nil
+}
+
+// registerWebhooks creates or updates the validating and mutating webhook
+// configurations named after the bootstrap name.
+func registerWebhooks(ctx context.Context, client kubernetes.Interface, c *Config, caBundle []byte) error {
+	namespaceSelector, objectSelector, err := webhookSelectors(c)
+	if err != nil {
+		return err
+	}
+	failurePolicy := admissionregistrationv1.Fail
+	if c.Policy.Failure == FailurePolicyIgnore {
+		failurePolicy = admissionregistrationv1.Ignore
+	}
+	// Reports are not sent for dry runs, mutations never have side effects.
+	validateSideEffects := admissionregistrationv1.SideEffectClassNoneOnDryRun
+	mutateSideEffects := admissionregistrationv1.SideEffectClassNone
+	clientConfig := func(path string) admissionregistrationv1.WebhookClientConfig {
+		return admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{
+				Namespace: c.Bootstrap.Namespace,
+				Name:      c.Bootstrap.Service,
+				Path:      &path,
+				Port:      &c.Bootstrap.Port,
+			},
+			CABundle: caBundle,
+		}
+	}
+	kinds := webhookKinds(c.Resources)
+
+	validating := client.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	validatingConfig, err := validating.Get(ctx, c.Bootstrap.Name, metav1.GetOptions{})
+	validatingExists := !errors.IsNotFound(err)
+	if err != nil && validatingExists {
+		return err
+	}
+	if !validatingExists {
+		validatingConfig = &admissionregistrationv1.ValidatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: c.Bootstrap.Name}}
+	}
+	validatingConfig.Webhooks = []admissionregistrationv1.ValidatingWebhook{{
+		Name:                    "validate.airgap.imperialops.io",
+		ClientConfig:            clientConfig("/validate"),
+		Rules:                   webhookRules(kinds, admissionregistrationv1.Create, admissionregistrationv1.Update, admissionregistrationv1.Delete),
+		FailurePolicy:           &failurePolicy,
+		NamespaceSelector:       namespaceSelector,
+		ObjectSelector:          objectSelector,
+		SideEffects:             &validateSideEffects,
+		AdmissionReviewVersions: []string{"v1", "v1beta1"},
+	}}
+	if !validatingExists {
+		_, err = validating.Create(ctx, validatingConfig, metav1.CreateOptions{})
+	} else {
+		_, err = validating.Update(ctx, validatingConfig, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	mutating := client.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	mutatingConfig, err := mutating.Get(ctx, c.Bootstrap.Name, metav1.GetOptions{})
+	mutatingExists := !errors.IsNotFound(err)
+	if err != nil && mutatingExists {
+		return err
+	}
+	if !mutatingExists {
+		mutatingConfig = &admissionregistrationv1.MutatingWebhookConfiguration{ObjectMeta: metav1.ObjectMeta{Name: c.Bootstrap.Name}}
+	}
+	mutatingConfig.Webhooks = []admissionregistrationv1.MutatingWebhook{{
+		Name:                    "mutate.airgap.imperialops.io",
+		ClientConfig:            clientConfig("/mutate"),
+		Rules:                   webhookRules(kinds, admissionregistrationv1.Create, admissionregistrationv1.Update),
+		FailurePolicy:           &failurePolicy,
+		NamespaceSelector:       namespaceSelector,
+		ObjectSelector:          objectSelector,
+		SideEffects:             &mutateSideEffects,
+		AdmissionReviewVersions: []string{"v1", "v1beta1"},
+	}}
+	if !mutatingExists {
+		_, err = mutating.Create(ctx, mutatingConfig, metav1.CreateOptions{})
+	} else {
+		_, err = mutating.Update(ctx, mutatingConfig, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("registered webhook configurations %s", c.Bootstrap.Name)
+	return nil
+}
+
+// webhookKinds returns the built-in kinds and those of the resource rules.
+func webhookKinds(resources []ConfigResourceRule) []schema.GroupVersionKind {
+	kinds := resourceHandlers.Kinds()
+	for _, rule := range resources {
+		// A rule without a version matches all of them, which the api
+		// server only accepts spelled as a wildcard. The empty group is
+		// the core group, so only "*" matches every group.
+		version := rule.Version
+		if version == "" {
+			version = "*"
+		}
+		kinds = append(kinds, schema.GroupVersionKind{Group: rule.Group, Version: version, Kind: rule.Kind})
+	}
+	return kinds
+}
+
+// webhookRules returns one rule per group and version matching the
+// resources of kinds, sorted to keep updates stable.
+func webhookRules(kinds []schema.GroupVersionKind, operations ...admissionregistrationv1.OperationType) []admissionregistrationv1.RuleWithOperations {
+	resources := map[schema.GroupVersion][]string{}
+	for _, gvk := range kinds {
+		resource := ""
+		// Ephemeral containers are a subresource of pods.
+		if gvk == corev1.SchemeGroupVersion.WithKind("EphemeralContainers") {
+			resource = "pods/ephemeralcontainers"
+		} else {
+			plural, _ := meta.UnsafeGuessKindToResource(gvk)
+			resource = plural.Resource
+		}
+		gv := gvk.GroupVersion()
+		if !containsString(resources[gv], resource) {
+			resources[gv] = append(resources[gv], resource)
+		}
+	}
+
+	rules := make([]admissionregistrationv1.RuleWithOperations, 0, len(resources))
+	for gv, names := range resources {
+		sort.Strings(names)
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: operations,
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{gv.Group},
+				APIVersions: []string{gv.Version},
+				Resources:   names,
+			},
+		})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i].Rule, rules[j].Rule
+		if a.APIGroups[0] != b.APIGroups[0] {
+			return a.APIGroups[0] < b.APIGroups[0]
+		}
+		return a.APIVersions[0] < b.APIVersions[0]
+	})
+	return rules
+}
+
+// webhookSelectors translates the scope into selectors, so the api server
+// does not call the webhook for requests it would skip anyway. The
+// namespace of the webhook is excluded so that its own pods can always
+// be scheduled.
+func webhookSelectors(c *Config) (*metav1.LabelSelector, *metav1.LabelSelector, error) {
+	namespaceSelector, err := metav1.ParseToLabelSelector(c.Scope.NamespaceSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	objectSelector, err := metav1.ParseToLabelSelector(c.Scope.ObjectSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(c.Scope.Namespaces) > 0 {
+		namespaceSelector.MatchExpressions = append(namespaceSelector.MatchExpressions, metav1.LabelSelectorRequirement{
+			Key:      namespaceNameLabel,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   c.Scope.Namespaces,
+		})
+	}
+	excluded := c.Scope.ExcludedNamespaces
+	if !containsString(excluded, c.Bootstrap.Namespace) {
+		excluded = append(append([]string{}, excluded...), c.Bootstrap.Namespace)
+	}
+	namespaceSelector.MatchExpressions = append(namespaceSelector.MatchExpressions, metav1.LabelSelectorRequirement{
+		Key:      namespaceNameLabel,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   excluded,
+	})
+	return namespaceSelector, objectSelector, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
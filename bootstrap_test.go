@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testBootstrapConfig(t *testing.T) *Config {
+	dir := t.TempDir()
+	return &Config{
+		Tls: ConfigTls{
+			Enabled:  true,
+			CertFile: filepath.Join(dir, "tls", "tls.crt"),
+			KeyFile:  filepath.Join(dir, "tls", "tls.key"),
+		},
+		Scope: ConfigScope{
+			ExcludedNamespaces: defaultExcludedNamespaces,
+			NamespaceSelector:  "airgap=enabled",
+		},
+		Policy: ConfigPolicy{Failure: FailurePolicyIgnore},
+		Bootstrap: ConfigBootstrap{
+			Enabled:   true,
+			Name:      "airgap-webhook",
+			Namespace: "airgap",
+			Service:   "airgap-webhook",
+			Port:      443,
+			Secret:    "airgap-webhook-tls",
+		},
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	ctx := context.Background()
+	config := testBootstrapConfig(t)
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "airgap-webhook", Labels: map[string]string{"app": "airgap-webhook"}},
+	})
+
+	assert.NoError(t, Bootstrap(ctx, client, config))
+
+	secret, err := client.CoreV1().Secrets("airgap").Get(ctx, "airgap-webhook-tls", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+
+	// The written key pair is served for the service name and trusted
+	// through the ca bundle.
+	cert, err := tls.LoadX509KeyPair(config.Tls.CertFile, config.Tls.KeyFile)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	assert.True(t, roots.AppendCertsFromPEM(secret.Data["ca.crt"]))
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "airgap-webhook.airgap.svc", Roots: roots})
+	assert.NoError(t, err)
+
+	validating, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "airgap-webhook", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, validating.Webhooks, 1)
+	webhook := validating.Webhooks[0]
+	assert.Equal(t, secret.Data["ca.crt"], webhook.ClientConfig.CABundle)
+	assert.Equal(t, "airgap", webhook.ClientConfig.Service.Namespace)
+	assert.Equal(t, "/validate", *webhook.ClientConfig.Service.Path)
+	assert.Equal(t, int32(443), *webhook.ClientConfig.Service.Port)
+	assert.Equal(t, admissionregistrationv1.Ignore, *webhook.FailurePolicy)
+	assert.Contains(t, webhook.Rules[0].Operations, admissionregistrationv1.Delete)
+	assert.Equal(t, map[string]string{"airgap": "enabled"}, webhook.NamespaceSelector.MatchLabels)
+	assert.Equal(t, []metav1.LabelSelectorRequirement{{
+		Key:      namespaceNameLabel,
+		Operator: metav1.LabelSelectorOpNotIn,
+		Values:   append(append([]string{}, defaultExcludedNamespaces...), "airgap"),
+	}}, webhook.NamespaceSelector.MatchExpressions)
+
+	mutating, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "airgap-webhook", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"app": "airgap-webhook"}, mutating.Labels, "existing configurations are updated in place")
+	assert.Len(t, mutating.Webhooks, 1)
+	assert.Equal(t, "/mutate", *mutating.Webhooks[0].ClientConfig.Service.Path)
+	assert.NotContains(t, mutating.Webhooks[0].Rules[0].Operations, admissionregistrationv1.Delete)
+
+	// A valid secret is reused on the next start.
+	assert.NoError(t, Bootstrap(ctx, client, config))
+	reused, err := client.CoreV1().Secrets("airgap").Get(ctx, "airgap-webhook-tls", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Data, reused.Data)
+}
+
+func TestBootstrapSecretRenewal(t *testing.T) {
+	ctx := context.Background()
+	config := testBootstrapConfig(t)
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "airgap-webhook-tls", Namespace: "airgap"},
+		Type:       corev1.SecretTypeTLS,
+		Data:       map[string][]byte{corev1.TLSCertKey: []byte("invalid"), corev1.TLSPrivateKeyKey: []byte("invalid")},
+	})
+
+	secret, err := bootstrapSecret(ctx, client, config.Bootstrap)
+	assert.NoError(t, err)
+	assert.True(t, validBootstrapSecret(secret, config.Bootstrap))
+
+	// A certificate for another service is replaced, signed by the same ca.
+	config.Bootstrap.Service = "images"
+	renewed, err := bootstrapSecret(ctx, client, config.Bootstrap)
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret.Data[corev1.TLSCertKey], renewed.Data[corev1.TLSCertKey])
+	assert.Equal(t, secret.Data["ca.crt"], renewed.Data["ca.crt"])
+	assert.Equal(t, secret.Data["ca.key"], renewed.Data["ca.key"])
+	assert.True(t, validBootstrapSecret(renewed, config.Bootstrap))
+
+	// Without its key the ca cannot sign a new certificate and is replaced.
+	delete(renewed.Data, "ca.key")
+	_, err = client.CoreV1().Secrets("airgap").Update(ctx, renewed, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	config.Bootstrap.Service = "airgap-webhook"
+	replaced, err := bootstrapSecret(ctx, client, config.Bootstrap)
+	assert.NoError(t, err)
+	assert.NotEqual(t, renewed.Data["ca.crt"], replaced.Data["ca.crt"])
+	assert.NotEmpty(t, replaced.Data["ca.key"])
+	assert.True(t, validBootstrapSecret(replaced, config.Bootstrap))
+}
+
+func TestWebhookRules(t *testing.T) {
+	kinds := []schema.GroupVersionKind{
+		{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Group: "", Version: "v1", Kind: "Pod"},
+		{Group: "", Version: "v1", Kind: "EphemeralContainers"},
+		{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+	}
+
+	rules := webhookRules(kinds, admissionregistrationv1.Create)
+	assert.Equal(t, []admissionregistrationv1.RuleWithOperations{
+		{Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create}, Rule: admissionregistrationv1.Rule{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"pods", "pods/ephemeralcontainers"}}},
+		{Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create}, Rule: admissionregistrationv1.Rule{APIGroups: []string{"apps"}, APIVersions: []string{"v1"}, Resources: []string{"deployments", "statefulsets"}}},
+		{Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create}, Rule: admissionregistrationv1.Rule{APIGroups: []string{"argoproj.io"}, APIVersions: []string{"v1alpha1"}, Resources: []string{"rollouts"}}},
+	}, rules)
+}
+
+func TestWebhookKinds(t *testing.T) {
+	tests := []struct {
+		rule     ConfigResourceRule
+		expected admissionregistrationv1.Rule
+	}{
+		{
+			rule:     ConfigResourceRule{Group: "tekton.dev", Version: "v1", Kind: "Task"},
+			expected: admissionregistrationv1.Rule{APIGroups: []string{"tekton.dev"}, APIVersions: []string{"v1"}, Resources: []string{"tasks"}},
+		},
+		{
+			rule:     ConfigResourceRule{Group: "argoproj.io", Kind: "Rollout"},
+			expected: admissionregistrationv1.Rule{APIGroups: []string{"argoproj.io"}, APIVersions: []string{"*"}, Resources: []string{"rollouts"}},
+		},
+		{
+			rule:     ConfigResourceRule{Group: "*", Version: "*", Kind: "Workflow"},
+			expected: admissionregistrationv1.Rule{APIGroups: []string{"*"}, APIVersions: []string{"*"}, Resources: []string{"workflows"}},
+		},
+	}
+
+	for _, test := range tests {
+		rules := webhookRules(webhookKinds([]ConfigResourceRule{test.rule}), admissionregistrationv1.Create)
+		assert.Contains(t, rules, admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+			Rule:       test.expected,
+		}, test.rule.Kind)
+		for _, rule := range rules {
+			assert.NotContains(t, rule.APIVersions, "", test.rule.Kind)
+		}
+	}
+}
+
+func TestWebhookSelectors(t *testing.T) {
+	config := testBootstrapConfig(t)
+	config.Scope = ConfigScope{Namespaces: []string{"payments"}, ObjectSelector: "app in (web)"}
+
+	namespaceSelector, objectSelector, err := webhookSelectors(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []metav1.LabelSelectorRequirement{
+		{Key: namespaceNameLabel, Operator: metav1.LabelSelectorOpIn, Values: []string{"payments"}},
+		{Key: namespaceNameLabel, Operator: metav1.LabelSelectorOpNotIn, Values: []string{"airgap"}},
+	}, namespaceSelector.MatchExpressions)
+	assert.Equal(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"web"}},
+	}, objectSelector.MatchExpressions)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// CertWatcher serves the tls key pair from disk and reloads it when the
+// files change, such as when cert-manager rotates the certificate.
+type CertWatcher struct {
+	certFile string
+	keyFile  string
+	watcher  *fsnotify.Watcher
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func NewCertWatcher(certFile string, keyFile string) (*CertWatcher, error) {
+	w := &CertWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := w.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// The directories are watched rather than the files, mounted secrets
+	// are updated by swapping a symlink.
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	w.watcher = watcher
+	go w.watch()
+	return w, nil
+}
+
+// GetCertificate returns the last key pair that loaded successfully.
+func (w *CertWatcher) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.cert, nil
+}
+
+func (w *CertWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+func (w *CertWatcher) watch() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			if err := w.load(); err != nil {
+				log.Printf("unable to reload tls key pair, serving the previous one: %s", err)
+				certReloads.WithLabelValues("failure").Inc()
+				continue
+			}
+			certReloads.WithLabelValues("success").Inc()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("tls key pair watch error: %s", err)
+		}
+	}
+}
+
+// load reads the key pair and swaps it in when it is valid.
+func (w *CertWatcher) load() error {
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cert != nil && w.cert.Leaf.Equal(leaf) {
+		return nil
+	}
+	w.cert = &cert
+	certExpiry.Set(float64(leaf.NotAfter.Unix()))
+	log.Printf("loaded tls certificate %s expiring %s", leaf.Subject, leaf.NotAfter)
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeKeyPair(t *testing.T, dir string, serial int64, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "airgap-webhook"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+}
+
+func TestCertWatcher(t *testing.T) {
+	dir := t.TempDir()
+	expiry := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	writeKeyPair(t, dir, 1, expiry)
+
+	certs, err := NewCertWatcher(filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key"))
+	assert.NoError(t, err)
+	defer certs.Close()
+
+	cert, err := certs.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), cert.Leaf.SerialNumber.Int64())
+	assert.Equal(t, float64(expiry.Unix()), testutil.ToFloat64(certExpiry))
+
+	rotated := expiry.Add(24 * time.Hour)
+	writeKeyPair(t, dir, 2, rotated)
+	assert.Eventually(t, func() bool {
+		cert, _ := certs.GetCertificate(nil)
+		return cert.Leaf.SerialNumber.Int64() == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(rotated.Unix()), testutil.ToFloat64(certExpiry))
+
+	failure := testutil.ToFloat64(certReloads.WithLabelValues("failure"))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), []byte("invalid"), 0o600))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(certReloads.WithLabelValues("failure")) > failure
+	}, 5*time.Second, 10*time.Millisecond)
+	cert, err = certs.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), cert.Leaf.SerialNumber.Int64(), "the last good key pair is served")
+}
+
+func TestNewCertWatcherErrors(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.crt"), []byte("invalid"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "tls.key"), []byte("invalid"), 0o600))
+
+	tests := map[string][2]string{
+		"missing": {filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key")},
+		"invalid": {filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")},
+	}
+	for name, files := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewCertWatcher(files[0], files[1])
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,28 +1,223 @@
 package main
 
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	BackendModeSync  = "sync"
+	BackendModeAsync = "async"
+)
+
+const (
+	ReportApiVersion = "airgap.imperialops.io/v1"
+	ReportKind       = "ImageReportList"
+)
+
 type IBackend interface {
-	Send([]Image) error
+	Send([]Report) error
+}
+
+// IContextBackend is implemented by backends whose sends can be bounded
+// by a context, such as the deadline of an admission request.
+type IContextBackend interface {
+	SendContext(ctx context.Context, reports []Report) error
+}
+
+// Report describes the images referenced by a single admission request.
+type Report struct {
+	Namespace string  `json:"namespace"`
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name"`
+	Operation string  `json:"operation"`
+	Images    []Image `json:"images"`
+	// Added and Removed are the images the operation adds to or removes
+	// from the workload. On DELETE every image of the workload is
+	// removed.
+	Added   []Image `json:"added,omitempty"`
+	Removed []Image `json:"removed,omitempty"`
+	// Violations lists policy violations that were allowed through in
+	// warn or audit mode.
+	Violations []string `json:"violations,omitempty"`
+	// Exemption is set when the workload is exempted from the policy
+	// by annotation.
+	Exemption *Exemption `json:"exemption,omitempty"`
+}
+
+// ReportList is the versioned document posted to the backend.
+type ReportList struct {
+	ApiVersion string   `json:"apiVersion"`
+	Kind       string   `json:"kind"`
+	Items      []Report `json:"items"`
+}
+
+func (r Report) Workload() Workload {
+	return Workload{
+		Namespace: r.Namespace,
+		Kind:      r.Kind,
+		Name:      r.Name,
+	}
 }
 
 type HttpClient struct {
 	config ConfigBackend
+	client *http.Client
 }
 
-func NewBackend(config ConfigBackend) IBackend {
-	switch config.protocol {
+func NewBackend(config ConfigBackend) (IBackend, error) {
+	var backend IBackend
+	switch config.Protocol {
 	case "http":
-		return NewHttpClient(config)
+		client, err := NewHttpClient(config)
+		if err != nil {
+			return nil, err
+		}
+		backend = client
+	case "embedded":
+		store, err := NewBoltStore(config.Path)
+		if err != nil {
+			return nil, err
+		}
+		backend = store
 	default:
-		return nil
+		return nil, nil
+	}
+
+	switch config.Mode {
+	case BackendModeAsync:
+		return NewQueue(backend, config.Queue)
+	default:
+		return backend, nil
 	}
 }
 
-func NewHttpClient(config ConfigBackend) *HttpClient {
+func NewHttpClient(config ConfigBackend) (*HttpClient, error) {
+	if config.Endpoint == "" {
+		return nil, errors.New("must supply backend endpoint")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.Tls.Enabled {
+		tlsConfig, err := newBackendTlsConfig(config.Tls)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
 	return &HttpClient{
 		config: config,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   config.Timeout,
+		},
+	}, nil
+}
+
+func newBackendTlsConfig(config ConfigBackendTls) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !config.Verify,
+	}
+
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load backend client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CaFile != "" {
+		ca, err := os.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read backend ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+func (c *HttpClient) Send(reports []Report) error {
+	return c.SendContext(context.Background(), reports)
+}
+
+// SendContext posts the reports, retrying failed posts with backoff. No
+// retry is started that could not finish before the deadline of ctx.
+func (c *HttpClient) SendContext(ctx context.Context, reports []Report) error {
+	if len(reports) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(ReportList{
+		ApiVersion: ReportApiVersion,
+		Kind:       ReportKind,
+		Items:      reports,
+	})
+	if err != nil {
+		return err
+	}
+
+	wait := c.config.RetryWait
+	for attempt := 0; ; attempt++ {
+		err = c.post(ctx, body)
+		if err == nil || attempt >= c.config.Retries || !isRetryable(err) {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+		log.Printf("backend send failed, retrying in %s: %s", wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		wait *= 2
 	}
 }
 
-func (c *HttpClient) Send([]Image) error {
+func (c *HttpClient) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return NewApiError(resp.StatusCode, fmt.Sprintf("backend responded with %s", resp.Status))
+	}
 	return nil
 }
+
+// isRetryable reports whether a failed send is worth retrying, which is
+// the case for transport errors and 5xx responses.
+func isRetryable(err error) bool {
+	var apiError *ApiError
+	if errors.As(err, &apiError) {
+		return apiError.Code() >= http.StatusInternalServerError
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testReports = []Report{
+	{
+		Namespace: "default",
+		Kind:      "Deployment",
+		Name:      "nginx-deployment",
+		Operation: "CREATE",
+		Images: []Image{
+			MustImage("public.ecr.aws/nginx/nginx:stable-perl@sha256:1b624e3e6af841b907b1f5747b6f29ccb5ccb422f9e881eae82bd4b8b72cb7a1"),
+			MustImage("busybox:1.28"),
+		},
+	},
+}
+
+func testBackendConfig(endpoint string) ConfigBackend {
+	return ConfigBackend{
+		Protocol: "http",
+		Endpoint: endpoint,
+		Retries:  3,
+	}
+}
+
+func TestHttpClientSend(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	client, err := NewHttpClient(testBackendConfig(server.URL))
+	assert.NoError(t, err)
+	assert.NoError(t, client.Send(testReports))
+
+	expected := `{
+		"apiVersion": "airgap.imperialops.io/v1",
+		"kind": "ImageReportList",
+		"items": [{
+			"namespace": "default",
+			"kind": "Deployment",
+			"name": "nginx-deployment",
+			"operation": "CREATE",
+			"images": [
+				{
+					"registry": "public.ecr.aws",
+					"repository": "nginx/nginx",
+					"tag": "stable-perl",
+					"hash": "sha256",
+					"digest": "1b624e3e6af841b907b1f5747b6f29ccb5ccb422f9e881eae82bd4b8b72cb7a1"
+				},
+				{
+					"registry": "docker.io",
+					"repository": "library/busybox",
+					"tag": "1.28"
+				}
+			]
+		}]
+	}`
+	assert.JSONEq(t, expected, string(body))
+
+	var decoded ReportList
+	assert.NoError(t, json.Unmarshal(body, &decoded))
+	assert.Equal(t, testReports, decoded.Items)
+}
+
+func TestHttpClientSendRetries(t *testing.T) {
+	tests := []struct {
+		statuses []int
+		attempts int32
+		fails    bool
+	}{
+		{[]int{http.StatusOK}, 1, false},
+		{[]int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, 3, false},
+		{[]int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}, 4, true},
+		{[]int{http.StatusBadRequest}, 1, true},
+	}
+
+	for _, test := range tests {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(test.statuses[n-1])
+		}))
+
+		client, err := NewHttpClient(testBackendConfig(server.URL))
+		assert.NoError(t, err)
+		err = client.Send(testReports)
+		server.Close()
+
+		assert.Equal(t, test.fails, err != nil, "statuses %v: unexpected error %v", test.statuses, err)
+		assert.Equal(t, test.attempts, attempts, "statuses %v", test.statuses)
+	}
+}
+
+func TestHandlePostValidateSyncDeadline(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := testBackendConfig(server.URL)
+	config.RetryWait = 400 * time.Millisecond
+	client, err := NewHttpClient(config)
+	assert.NoError(t, err)
+	s := &ApiServerCommon{
+		config:  &Config{},
+		backend: client,
+		policy:  NewPolicy(ConfigPolicy{Failure: FailurePolicyFail}, nil, nil, nil),
+	}
+
+	// Retries stop short of the webhook timeout, so the review is answered
+	// before the api server gives up on it.
+	r := httptest.NewRequest(http.MethodPost, "/validate?timeout=1s", bytes.NewReader(newReview(t, v1Job)))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	newApiFunc(s.handleValidate)(w, r)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.False(t, decodeResponse(t, w.Body.Bytes()).Allowed)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestHttpClientSendTls(t *testing.T) {
+	var called bool
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer server.Close()
+
+	config := testBackendConfig(server.URL)
+	config.Retries = 0
+	config.Tls.Enabled = true
+	config.Tls.Verify = true
+
+	client, err := NewHttpClient(config)
+	assert.NoError(t, err)
+	assert.Error(t, client.Send(testReports), "self signed certificate must not verify")
+	assert.False(t, called)
+
+	config.Tls.Verify = false
+	client, err = NewHttpClient(config)
+	assert.NoError(t, err)
+	assert.NoError(t, client.Send(testReports))
+	assert.True(t, called)
+}
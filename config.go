@@ -2,82 +2,492 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
+// Config is read from the file given with --config, AG_ environment
+// variables and flags, see README.md for the full schema.
 type Config struct {
-	cfgFile    string        `json:"cfgFile"`
-	listenAddr string        `json:"listenAddr"`
-	apiAddr    string        `json:"apiAddr"`
-	tls        ConfigTls     `json:"tls"`
-	backend    ConfigBackend `json:"backend"`
+	CfgFile           string               `json:"-"`
+	ListenAddr        string               `json:"listenAddr"`
+	ApiAddr           string               `json:"apiAddr"`
+	ShutdownTimeout   time.Duration        `json:"shutdownTimeout"`
+	Tls               ConfigTls            `json:"tls"`
+	Backend           ConfigBackend        `json:"backend"`
+	Policy            ConfigPolicy         `json:"policy"`
+	Mirror            ConfigMirror         `json:"mirror"`
+	Digest            ConfigDigest         `json:"digest"`
+	Resources         []ConfigResourceRule `json:"resources"`
+	ResourceRulesFile string               `json:"resourceRulesFile"`
+	Scope             ConfigScope          `json:"scope"`
+	Bootstrap         ConfigBootstrap      `json:"bootstrap"`
+	// args are the command line arguments, reapplied on reload.
+	args []string
+}
+
+// configKeys binds flags to their key in config files, environment
+// variables are named after the key, e.g. AG_BACKEND_QUEUE_WALDIR.
+var configKeys = map[string]string{
+	"listen-address":             "listenAddr",
+	"api-address":                "apiAddr",
+	"shutdown-timeout":           "shutdownTimeout",
+	"tls-enabled":                "tls.enabled",
+	"tls-cert":                   "tls.certFile",
+	"tls-key":                    "tls.keyFile",
+	"namespaces":                 "scope.namespaces",
+	"excluded-namespaces":        "scope.excludedNamespaces",
+	"namespace-selector":         "scope.namespaceSelector",
+	"object-selector":            "scope.objectSelector",
+	"registry-policy-mode":       "policy.registries.mode",
+	"allowed-registries":         "policy.registries.allowed",
+	"unknown-kinds":              "policy.unknownKinds",
+	"failure-policy":             "policy.failure",
+	"exemption-users":            "policy.exemptions.users",
+	"exemption-groups":           "policy.exemptions.groups",
+	"exemption-controllers":      "policy.exemptions.controllers",
+	"require-digest":             "policy.digests.required",
+	"digest-policy-mode":         "policy.digests.mode",
+	"pin-digests":                "digest.pin",
+	"digest-catalog":             "digest.catalogFile",
+	"resource-rules":             "resourceRulesFile",
+	"backend-protocol":           "backend.protocol",
+	"backend-endpoint":           "backend.endpoint",
+	"backend-path":               "backend.path",
+	"backend-mode":               "backend.mode",
+	"backend-queue-capacity":     "backend.queue.capacity",
+	"backend-queue-workers":      "backend.queue.workers",
+	"backend-queue-batch-size":   "backend.queue.batchSize",
+	"backend-queue-batch-window": "backend.queue.batchWindow",
+	"backend-queue-backoff":      "backend.queue.backoff",
+	"backend-queue-max-backoff":  "backend.queue.maxBackoff",
+	"backend-queue-wal-dir":      "backend.queue.walDir",
+	"backend-queue-wal-max-size": "backend.queue.walMaxSize",
+	"backend-timeout":            "backend.timeout",
+	"backend-retries":            "backend.retries",
+	"backend-retry-wait":         "backend.retryWait",
+	"backend-tls-enabled":        "backend.tls.enabled",
+	"backend-tls-verify":         "backend.tls.verify",
+	"backend-tls-cert":           "backend.tls.certFile",
+	"backend-tls-key":            "backend.tls.keyFile",
+	"backend-tls-ca":             "backend.tls.caFile",
+	"bootstrap":                  "bootstrap.enabled",
+	"bootstrap-name":             "bootstrap.name",
+	"bootstrap-namespace":        "bootstrap.namespace",
+	"bootstrap-service":          "bootstrap.service",
+	"bootstrap-port":             "bootstrap.port",
+	"bootstrap-secret":           "bootstrap.secret",
+}
+
+// ConfigBootstrap names the Service, Secret and webhook configurations
+// managed when the webhook bootstraps its own tls.
+type ConfigBootstrap struct {
+	Enabled   bool   `json:"enabled"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	Port      int32  `json:"port"`
+	Secret    string `json:"secret"`
+}
+
+type ConfigScope struct {
+	Namespaces         []string `json:"namespaces"`
+	ExcludedNamespaces []string `json:"excludedNamespaces"`
+	NamespaceSelector  string   `json:"namespaceSelector"`
+	ObjectSelector     string   `json:"objectSelector"`
+}
+
+type ConfigResourceRule struct {
+	Group        string   `json:"group"`
+	Version      string   `json:"version"`
+	Kind         string   `json:"kind"`
+	Paths        []string `json:"paths"`
+	PodTemplates bool     `json:"podTemplates"`
+}
+
+type ConfigDigest struct {
+	Pin         bool   `json:"pin"`
+	CatalogFile string `json:"catalogFile"`
+}
+
+type ConfigDigestPolicy struct {
+	Mode     string `json:"mode"`
+	Required bool   `json:"required"`
+}
+
+type ConfigMirror struct {
+	Rules []ConfigMirrorRule `json:"rules"`
+}
+
+type ConfigMirrorRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type ConfigPolicy struct {
+	Registries   ConfigRegistryPolicy `json:"registries"`
+	Digests      ConfigDigestPolicy   `json:"digests"`
+	UnknownKinds string               `json:"unknownKinds"`
+	Failure      string               `json:"failure"`
+	Exemptions   ConfigExemptions     `json:"exemptions"`
+}
+
+type ConfigExemptions struct {
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+	// Controllers are the users and groups whose objects inherit the
+	// exemption of the object controlling them.
+	Controllers []string `json:"controllers"`
+}
+
+type ConfigRegistryPolicy struct {
+	Mode    string   `json:"mode"`
+	Allowed []string `json:"allowed"`
 }
 
 type ConfigTls struct {
-	enabled  bool   `json:"enabled"`
-	certFile string `json:"certFile"`
-	keyFile  string `json:"keyFile"`
+	Enabled  bool   `json:"enabled"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
 }
 
 type ConfigBackend struct {
-	protocol string           `json:"protocol"`
-	endpoint string           `json:"endpoint"`
-	tls      ConfigBackendTls `json:"tls"`
+	Protocol  string           `json:"protocol"`
+	Endpoint  string           `json:"endpoint"`
+	Path      string           `json:"path"`
+	Mode      string           `json:"mode"`
+	Timeout   time.Duration    `json:"timeout"`
+	Retries   int              `json:"retries"`
+	RetryWait time.Duration    `json:"retryWait"`
+	Queue     ConfigQueue      `json:"queue"`
+	Tls       ConfigBackendTls `json:"tls"`
+}
+
+type ConfigQueue struct {
+	Capacity    int           `json:"capacity"`
+	Workers     int           `json:"workers"`
+	BatchSize   int           `json:"batchSize"`
+	BatchWindow time.Duration `json:"batchWindow"`
+	Backoff     time.Duration `json:"backoff"`
+	MaxBackoff  time.Duration `json:"maxBackoff"`
+	WalDir      string        `json:"walDir"`
+	WalMaxSize  int64         `json:"walMaxSize"`
 }
 
 type ConfigBackendTls struct {
-	enabled  bool   `json:"enabled"`
-	verify   bool   `json:"verify"`
-	certFile string `json:"certFile"`
-	keyFile  string `json:"keyFile"`
+	Enabled  bool   `json:"enabled"`
+	Verify   bool   `json:"verify"`
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	CaFile   string `json:"caFile"`
 }
 
 func NewConfig() (*Config, error) {
+	return LoadConfig(os.Args[1:])
+}
+
+// LoadConfig parses args and merges them with the config file and the
+// environment. Flags take precedence over environment variables, which
+// take precedence over the config file and then the defaults.
+func LoadConfig(args []string) (*Config, error) {
 	config := Config{
-		cfgFile:    "",
-		listenAddr: "0.0.0.0:8080",
-		apiAddr:    "",
-		tls: ConfigTls{
-			enabled:  false,
-			certFile: "",
-			keyFile:  "",
+		CfgFile:         "",
+		ListenAddr:      "0.0.0.0:8080",
+		ApiAddr:         "127.0.0.1:8081",
+		ShutdownTimeout: 20 * time.Second,
+		Tls: ConfigTls{
+			Enabled:  false,
+			CertFile: "",
+			KeyFile:  "",
+		},
+		Scope: ConfigScope{
+			Namespaces:         ParseNamespaces(os.Getenv("NAMESPACE")),
+			ExcludedNamespaces: defaultExcludedNamespaces,
+		},
+		Policy: ConfigPolicy{
+			Registries: ConfigRegistryPolicy{
+				Mode: PolicyModeEnforce,
+			},
+			Digests: ConfigDigestPolicy{
+				Mode:     PolicyModeEnforce,
+				Required: false,
+			},
+			UnknownKinds: UnknownKindAllow,
+			Failure:      FailurePolicyFail,
+			Exemptions: ConfigExemptions{
+				Controllers: defaultExemptionControllers,
+			},
+		},
+		Bootstrap: ConfigBootstrap{
+			Enabled: false,
+			Name:    "airgap-webhook",
+			Service: "airgap-webhook",
+			Port:    443,
+			Secret:  "airgap-webhook-tls",
+		},
+		Backend: ConfigBackend{
+			Protocol:  "",
+			Endpoint:  "",
+			Path:      "/var/lib/airgap-webhook/inventory.db",
+			Mode:      BackendModeAsync,
+			Timeout:   10 * time.Second,
+			Retries:   3,
+			RetryWait: 500 * time.Millisecond,
+			Queue: ConfigQueue{
+				Capacity:    1000,
+				Workers:     2,
+				BatchSize:   100,
+				BatchWindow: time.Second,
+				Backoff:     time.Second,
+				MaxBackoff:  5 * time.Minute,
+				WalDir:      "",
+				WalMaxSize:  256 << 20,
+			},
+			Tls: ConfigBackendTls{
+				Enabled: false,
+				Verify:  true,
+			},
 		},
 	}
 
-	pflag.StringVar(&config.cfgFile, "config", config.cfgFile, "config file location")
-	pflag.StringVar(&config.listenAddr, "listen-address", config.listenAddr, "server listen address")
-	pflag.BoolVar(&config.tls.enabled, "tls-enabled", config.tls.enabled, "controls whether tls is enabled, good for testing")
-	pflag.StringVar(&config.tls.certFile, "tls-cert", config.tls.certFile, "tls certificate to serve")
-	pflag.StringVar(&config.tls.keyFile, "tls-key", config.tls.keyFile, "tls key")
+	flags := pflag.NewFlagSet("airgap-webhook", pflag.ContinueOnError)
+	flags.StringVar(&config.CfgFile, "config", config.CfgFile, "config file location")
+	flags.StringVar(&config.ListenAddr, "listen-address", config.ListenAddr, "server listen address")
+	flags.StringVar(&config.ApiAddr, "api-address", config.ApiAddr, "plain http listen address of the unauthenticated inventory api, empty to disable it")
+	flags.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "how long in-flight requests and queued backend reports are given to finish on SIGTERM")
+	flags.BoolVar(&config.Tls.Enabled, "tls-enabled", config.Tls.Enabled, "controls whether tls is enabled, good for testing")
+	flags.StringVar(&config.Tls.CertFile, "tls-cert", config.Tls.CertFile, "tls certificate to serve")
+	flags.StringVar(&config.Tls.KeyFile, "tls-key", config.Tls.KeyFile, "tls key")
+	flags.StringSliceVar(&config.Scope.Namespaces, "namespaces", config.Scope.Namespaces, "namespaces the webhook inspects, all when empty, defaults to the NAMESPACE environment variable")
+	flags.StringSliceVar(&config.Scope.ExcludedNamespaces, "excluded-namespaces", config.Scope.ExcludedNamespaces, "namespaces the webhook never inspects")
+	flags.StringVar(&config.Scope.NamespaceSelector, "namespace-selector", config.Scope.NamespaceSelector, "label selector of the namespaces the webhook inspects, e.g. airgap=enabled")
+	flags.StringVar(&config.Scope.ObjectSelector, "object-selector", config.Scope.ObjectSelector, "label selector of the objects the webhook inspects")
+	flags.StringVar(&config.Policy.Registries.Mode, "registry-policy-mode", config.Policy.Registries.Mode, "registry policy mode, one of enforce, warn or audit")
+	flags.StringSliceVar(&config.Policy.Registries.Allowed, "allowed-registries", config.Policy.Registries.Allowed, "registries images may be pulled from, exact hosts or wildcards like *.example.com, empty allows all")
+	flags.StringVar(&config.Policy.UnknownKinds, "unknown-kinds", config.Policy.UnknownKinds, "how requests for kinds without image extraction are answered, one of allow, warn or deny")
+	flags.StringVar(&config.Policy.Failure, "failure-policy", config.Policy.Failure, "whether requests the webhook fails to process are denied or allowed, one of fail or ignore")
+	flags.StringSliceVar(&config.Policy.Exemptions.Users, "exemption-users", config.Policy.Exemptions.Users, "users allowed to exempt workloads with the "+ExemptAnnotation+" annotation")
+	flags.StringSliceVar(&config.Policy.Exemptions.Groups, "exemption-groups", config.Policy.Exemptions.Groups, "groups allowed to exempt workloads with the "+ExemptAnnotation+" annotation")
+	flags.StringSliceVar(&config.Policy.Exemptions.Controllers, "exemption-controllers", config.Policy.Exemptions.Controllers, "users and groups of the controllers whose objects inherit the exemption of their owner")
+	flags.BoolVar(&config.Policy.Digests.Required, "require-digest", config.Policy.Digests.Required, "deny images that are not pinned to a digest and have no digest in the catalog")
+	flags.StringVar(&config.Policy.Digests.Mode, "digest-policy-mode", config.Policy.Digests.Mode, "digest policy mode, one of enforce, warn or audit")
+	flags.BoolVar(&config.Digest.Pin, "pin-digests", config.Digest.Pin, "pin image tags to their catalog digest on /mutate")
+	flags.StringVar(&config.Digest.CatalogFile, "digest-catalog", config.Digest.CatalogFile, "yaml or json file mapping image tags to digests, written by the mirror sync")
+	flags.StringVar(&config.ResourceRulesFile, "resource-rules", config.ResourceRulesFile, "yaml or json file of rules extracting images from kinds without built-in support")
+	mirrorRules := []string{}
+	flags.StringSliceVar(&mirrorRules, "registry-mirror", mirrorRules, "rewrite images on /mutate with from=to rules, e.g. docker.io=mirror.internal/docker.io, the first matching rule wins")
+	flags.StringVar(&config.Backend.Protocol, "backend-protocol", config.Backend.Protocol, "backend protocol, one of http, embedded or empty to disable")
+	flags.StringVar(&config.Backend.Endpoint, "backend-endpoint", config.Backend.Endpoint, "backend url that image reports are posted to")
+	flags.StringVar(&config.Backend.Path, "backend-path", config.Backend.Path, "database file of the embedded backend")
+	flags.StringVar(&config.Backend.Mode, "backend-mode", config.Backend.Mode, "sync blocks admission until reports are stored, async queues them")
+	flags.IntVar(&config.Backend.Queue.Capacity, "backend-queue-capacity", config.Backend.Queue.Capacity, "number of pending reports held in memory in async mode")
+	flags.IntVar(&config.Backend.Queue.Workers, "backend-queue-workers", config.Backend.Queue.Workers, "number of workers delivering reports in async mode")
+	flags.IntVar(&config.Backend.Queue.BatchSize, "backend-queue-batch-size", config.Backend.Queue.BatchSize, "maximum number of reports delivered in one request")
+	flags.DurationVar(&config.Backend.Queue.BatchWindow, "backend-queue-batch-window", config.Backend.Queue.BatchWindow, "how long a worker waits to fill a batch")
+	flags.DurationVar(&config.Backend.Queue.Backoff, "backend-queue-backoff", config.Backend.Queue.Backoff, "initial wait before redelivering a failed batch")
+	flags.DurationVar(&config.Backend.Queue.MaxBackoff, "backend-queue-max-backoff", config.Backend.Queue.MaxBackoff, "maximum wait between redeliveries of a failed batch")
+	flags.StringVar(&config.Backend.Queue.WalDir, "backend-queue-wal-dir", config.Backend.Queue.WalDir, "directory of the write-ahead log that persists pending reports, empty to keep them in memory only")
+	flags.Int64Var(&config.Backend.Queue.WalMaxSize, "backend-queue-wal-max-size", config.Backend.Queue.WalMaxSize, "maximum size in bytes of the reports pending in the write-ahead log, 0 for unlimited")
+	flags.DurationVar(&config.Backend.Timeout, "backend-timeout", config.Backend.Timeout, "timeout of a single backend request")
+	flags.IntVar(&config.Backend.Retries, "backend-retries", config.Backend.Retries, "number of retries on backend connection errors and 5xx responses")
+	flags.DurationVar(&config.Backend.RetryWait, "backend-retry-wait", config.Backend.RetryWait, "initial wait between backend retries, doubled on every retry")
+	flags.BoolVar(&config.Backend.Tls.Enabled, "backend-tls-enabled", config.Backend.Tls.Enabled, "controls whether tls settings are applied to the backend client")
+	flags.BoolVar(&config.Backend.Tls.Verify, "backend-tls-verify", config.Backend.Tls.Verify, "verify the backend server certificate")
+	flags.StringVar(&config.Backend.Tls.CertFile, "backend-tls-cert", config.Backend.Tls.CertFile, "client certificate presented to the backend")
+	flags.StringVar(&config.Backend.Tls.KeyFile, "backend-tls-key", config.Backend.Tls.KeyFile, "client certificate key")
+	flags.StringVar(&config.Backend.Tls.CaFile, "backend-tls-ca", config.Backend.Tls.CaFile, "ca bundle used to verify the backend server certificate")
+	flags.BoolVar(&config.Bootstrap.Enabled, "bootstrap", config.Bootstrap.Enabled, "generate the serving certificate into a Secret and register the webhook configurations on startup")
+	flags.StringVar(&config.Bootstrap.Name, "bootstrap-name", config.Bootstrap.Name, "name of the registered validating and mutating webhook configurations")
+	flags.StringVar(&config.Bootstrap.Namespace, "bootstrap-namespace", config.Bootstrap.Namespace, "namespace of the webhook service and tls secret")
+	flags.StringVar(&config.Bootstrap.Service, "bootstrap-service", config.Bootstrap.Service, "service the api server reaches the webhook through")
+	flags.Int32Var(&config.Bootstrap.Port, "bootstrap-port", config.Bootstrap.Port, "port of the webhook service")
+	flags.StringVar(&config.Bootstrap.Secret, "bootstrap-secret", config.Bootstrap.Secret, "secret holding the generated ca and serving certificate")
 
-	pflag.Parse()
-	viper.BindPFlags(pflag.CommandLine)
+	if err := flags.Parse(args); err != nil {
+		return &config, err
+	}
+	config.args = args
 
-	if config.cfgFile != "" {
-		viper.SetConfigFile(config.cfgFile)
-		if err := viper.ReadInConfig(); err != nil {
+	v := viper.New()
+	for flag, key := range configKeys {
+		if err := v.BindPFlag(key, flags.Lookup(flag)); err != nil {
+			return &config, err
+		}
+	}
+	v.SetEnvPrefix("ag")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+	if config.CfgFile != "" {
+		v.SetConfigFile(config.CfgFile)
+		if err := v.ReadInConfig(); err != nil {
 			return &config, err
 		}
 	}
 
-	viper.SetEnvPrefix("ag")
-	viper.AutomaticEnv()
+	// Unknown keys are most likely typos, they are rejected rather than
+	// silently ignored.
+	err := v.UnmarshalExact(&config, func(c *mapstructure.DecoderConfig) {
+		c.TagName = "json"
+	})
+	if err != nil {
+		return &config, fmt.Errorf("invalid config: %w", err)
+	}
 
-	if err := viper.Unmarshal(&config); err != nil {
-		return &config, err
+	if config.ResourceRulesFile != "" {
+		rules, err := LoadResourceRules(config.ResourceRulesFile)
+		if err != nil {
+			return &config, err
+		}
+		config.Resources = append(config.Resources, rules...)
+	}
+	// Mirror rules given on the command line replace those of the config
+	// file.
+	if flags.Changed("registry-mirror") {
+		config.Mirror.Rules = nil
+		for _, s := range mirrorRules {
+			rule, err := ParseMirrorRule(s)
+			if err != nil {
+				return &config, err
+			}
+			config.Mirror.Rules = append(config.Mirror.Rules, rule)
+		}
+	}
+
+	return &config, config.Validate()
+}
+
+// Watch reloads the config whenever the config file changes, including
+// through the symlink swap of a mounted ConfigMap, and hands it to apply.
+// Configs that are invalid or fail to apply are logged and the running
+// config stays in place.
+func (c *Config) Watch(apply func(*Config) error) {
+	if c.CfgFile == "" {
+		return
 	}
 
-	// validate
-	if config.tls.enabled {
-		if config.tls.certFile == "" {
-			return &config, errors.New("must supply certificate file")
+	v := viper.New()
+	v.SetConfigFile(c.CfgFile)
+	v.OnConfigChange(func(e fsnotify.Event) {
+		next, err := LoadConfig(c.args)
+		if err == nil {
+			err = apply(next)
+		}
+		if err != nil {
+			log.Printf("rejected config reload from %s: %s", e.Name, err)
+			configReloads.WithLabelValues("failure").Inc()
+			return
+		}
+		log.Printf("reloaded config from %s", e.Name)
+		configReloads.WithLabelValues("success").Inc()
+	})
+	v.WatchConfig()
+}
+
+// Validate checks the config is consistent and complete.
+func (c *Config) Validate() error {
+	if _, err := NewResourceRules(c.Resources); err != nil {
+		return err
+	}
+	if _, err := labels.Parse(c.Scope.NamespaceSelector); err != nil {
+		return fmt.Errorf("invalid namespace selector: %w", err)
+	}
+	if _, err := labels.Parse(c.Scope.ObjectSelector); err != nil {
+		return fmt.Errorf("invalid object selector: %w", err)
+	}
+	if !isPolicyMode(c.Policy.Registries.Mode) {
+		return fmt.Errorf("unknown registry policy mode %s", c.Policy.Registries.Mode)
+	}
+	if !isUnknownKindPolicy(c.Policy.UnknownKinds) {
+		return fmt.Errorf("unknown kind policy must be allow, warn or deny, got %s", c.Policy.UnknownKinds)
+	}
+	if !isFailurePolicy(c.Policy.Failure) {
+		return fmt.Errorf("failure policy must be fail or ignore, got %s", c.Policy.Failure)
+	}
+	if !isPolicyMode(c.Policy.Digests.Mode) {
+		return fmt.Errorf("unknown digest policy mode %s", c.Policy.Digests.Mode)
+	}
+	for _, pattern := range c.Policy.Registries.Allowed {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid allowed registry pattern %s: %w", pattern, err)
+		}
+	}
+	for _, rule := range c.Mirror.Rules {
+		if _, err := ParseMirrorRule(rule.From + "=" + rule.To); err != nil || strings.HasSuffix(rule.To, "/") {
+			return fmt.Errorf("invalid mirror rule from %q to %q", rule.From, rule.To)
+		}
+	}
+	if c.ShutdownTimeout <= 0 {
+		return errors.New("shutdown timeout must be positive")
+	}
+	if c.Tls.Enabled {
+		if c.Tls.CertFile == "" {
+			return errors.New("must supply certificate file")
+		}
+		if c.Tls.KeyFile == "" {
+			return errors.New("must supply private key file")
 		}
-		if config.tls.keyFile == "" {
-			return &config, errors.New("must supply private key file")
+	}
+	if c.Bootstrap.Enabled {
+		if !c.Tls.Enabled {
+			return errors.New("bootstrap requires tls to be enabled")
+		}
+		if c.Bootstrap.Name == "" || c.Bootstrap.Namespace == "" || c.Bootstrap.Service == "" || c.Bootstrap.Secret == "" {
+			return errors.New("bootstrap requires a name, namespace, service and secret")
+		}
+		if c.Bootstrap.Port < 1 || c.Bootstrap.Port > 65535 {
+			return fmt.Errorf("bootstrap port must be between 1 and 65535, got %d", c.Bootstrap.Port)
+		}
+	}
+	switch c.Backend.Protocol {
+	case "":
+	case "http":
+		endpoint, err := url.Parse(c.Backend.Endpoint)
+		if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("backend endpoint must be an http or https url, got %q", c.Backend.Endpoint)
+		}
+	case "embedded":
+		if c.Backend.Path == "" {
+			return errors.New("embedded backend requires a database path")
+		}
+	default:
+		return fmt.Errorf("unknown backend protocol %s", c.Backend.Protocol)
+	}
+	switch c.Backend.Mode {
+	case BackendModeSync, BackendModeAsync:
+	default:
+		return fmt.Errorf("unknown backend mode %s", c.Backend.Mode)
+	}
+	if c.Backend.Timeout <= 0 {
+		return errors.New("backend timeout must be positive")
+	}
+	if c.Backend.Retries < 0 || c.Backend.RetryWait < 0 {
+		return errors.New("backend retries and retry wait must not be negative")
+	}
+	if c.Backend.Queue.Backoff <= 0 || c.Backend.Queue.MaxBackoff < c.Backend.Queue.Backoff {
+		return errors.New("backend queue backoff must be positive and at most the max backoff")
+	}
+	if c.Backend.Queue.WalMaxSize < 0 {
+		return errors.New("backend queue wal max size must not be negative")
+	}
+	if c.Backend.Queue.Capacity < 1 || c.Backend.Queue.Workers < 1 || c.Backend.Queue.BatchSize < 1 {
+		return errors.New("backend queue capacity, workers and batch size must be positive")
+	}
+	if c.Backend.Tls.Enabled {
+		if (c.Backend.Tls.CertFile == "") != (c.Backend.Tls.KeyFile == "") {
+			return errors.New("backend client certificate and key must be supplied together")
 		}
 	}
 
-	return &config, nil
+	return nil
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	config, err := LoadConfig([]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:8080", config.ListenAddr)
+	assert.Equal(t, "127.0.0.1:8081", config.ApiAddr)
+	assert.Equal(t, PolicyModeEnforce, config.Policy.Registries.Mode)
+	assert.Equal(t, defaultExcludedNamespaces, config.Scope.ExcludedNamespaces)
+	assert.Equal(t, BackendModeAsync, config.Backend.Mode)
+	assert.Equal(t, 10*time.Second, config.Backend.Timeout)
+	assert.True(t, config.Backend.Tls.Verify)
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+listenAddr: 0.0.0.0:8443
+policy:
+  registries:
+    mode: warn
+    allowed: [mirror.internal]
+mirror:
+  rules:
+  - from: docker.io
+    to: mirror.internal/docker.io
+backend:
+  protocol: http
+  endpoint: https://inventory.internal/reports
+  timeout: 3s
+  queue:
+    walDir: /var/lib/airgap-webhook/wal
+  tls:
+    enabled: true
+    caFile: /etc/airgap/ca.pem
+`,
+		"config.json": `{
+  "listenAddr": "0.0.0.0:8443",
+  "policy": {"registries": {"mode": "warn", "allowed": ["mirror.internal"]}},
+  "mirror": {"rules": [{"from": "docker.io", "to": "mirror.internal/docker.io"}]},
+  "backend": {
+    "protocol": "http",
+    "endpoint": "https://inventory.internal/reports",
+    "timeout": "3s",
+    "queue": {"walDir": "/var/lib/airgap-webhook/wal"},
+    "tls": {"enabled": true, "caFile": "/etc/airgap/ca.pem"}
+  }
+}`,
+		"config.toml": `
+listenAddr = "0.0.0.0:8443"
+
+[policy.registries]
+mode = "warn"
+allowed = ["mirror.internal"]
+
+[[mirror.rules]]
+from = "docker.io"
+to = "mirror.internal/docker.io"
+
+[backend]
+protocol = "http"
+endpoint = "https://inventory.internal/reports"
+timeout = "3s"
+
+[backend.queue]
+walDir = "/var/lib/airgap-webhook/wal"
+
+[backend.tls]
+enabled = true
+caFile = "/etc/airgap/ca.pem"
+`,
+	}
+
+	for name, content := range files {
+		config, err := LoadConfig([]string{"--config", writeConfig(t, name, content)})
+		assert.NoError(t, err, name)
+		assert.Equal(t, "0.0.0.0:8443", config.ListenAddr, name)
+		assert.Equal(t, ConfigRegistryPolicy{Mode: PolicyModeWarn, Allowed: []string{"mirror.internal"}}, config.Policy.Registries, name)
+		assert.Equal(t, []ConfigMirrorRule{{From: "docker.io", To: "mirror.internal/docker.io"}}, config.Mirror.Rules, name)
+		assert.Equal(t, "http", config.Backend.Protocol, name)
+		assert.Equal(t, "https://inventory.internal/reports", config.Backend.Endpoint, name)
+		assert.Equal(t, 3*time.Second, config.Backend.Timeout, name)
+		assert.Equal(t, "/var/lib/airgap-webhook/wal", config.Backend.Queue.WalDir, name)
+		assert.Equal(t, ConfigBackendTls{Enabled: true, Verify: true, CaFile: "/etc/airgap/ca.pem"}, config.Backend.Tls, name)
+		// Values not in the file keep their defaults.
+		assert.Equal(t, 1000, config.Backend.Queue.Capacity, name)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "config.yaml", `
+listenAddr: 0.0.0.0:8443
+apiAddr: 0.0.0.0:9090
+policy:
+  unknownKinds: warn
+backend:
+  retries: 5
+`)
+
+	t.Setenv("AG_APIADDR", "0.0.0.0:9191")
+	t.Setenv("AG_POLICY_UNKNOWNKINDS", "deny")
+	t.Setenv("AG_POLICY_REGISTRIES_ALLOWED", "mirror.internal,*.corp")
+	t.Setenv("AG_BACKEND_QUEUE_BATCHWINDOW", "2s")
+
+	config, err := LoadConfig([]string{"--config", path, "--unknown-kinds", "allow"})
+	assert.NoError(t, err)
+	assert.Equal(t, "0.0.0.0:8443", config.ListenAddr, "file over default")
+	assert.Equal(t, "0.0.0.0:9191", config.ApiAddr, "environment over file")
+	assert.Equal(t, UnknownKindAllow, config.Policy.UnknownKinds, "flag over environment")
+	assert.Equal(t, 5, config.Backend.Retries)
+	assert.Equal(t, []string{"mirror.internal", "*.corp"}, config.Policy.Registries.Allowed)
+	assert.Equal(t, 2*time.Second, config.Backend.Queue.BatchWindow)
+
+	config, err = LoadConfig([]string{"--config", path, "--registry-mirror", "quay.io=mirror.internal/quay.io"})
+	assert.NoError(t, err)
+	assert.Equal(t, []ConfigMirrorRule{{From: "quay.io", To: "mirror.internal/quay.io"}}, config.Mirror.Rules)
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		args    []string
+	}{
+		{"unknown key", "listenAddress: 0.0.0.0:8443", nil},
+		{"unknown nested key", "backend:\n  queue:\n    size: 10", nil},
+		{"invalid duration", "backend:\n  timeout: soon", nil},
+		{"unknown protocol", "backend:\n  protocol: grpc", nil},
+		{"http without endpoint", "backend:\n  protocol: http", nil},
+		{"relative endpoint", "backend:\n  protocol: http\n  endpoint: inventory/reports", nil},
+		{"embedded without path", "backend:\n  protocol: embedded\n  path: \"\"", nil},
+		{"zero timeout", "backend:\n  timeout: 0s", nil},
+		{"negative retries", "backend:\n  retries: -1", nil},
+		{"backoff above max", "backend:\n  queue:\n    backoff: 10m", nil},
+		{"client cert without key", "backend:\n  tls:\n    enabled: true\n    certFile: client.pem", nil},
+		{"invalid mirror rule", "mirror:\n  rules:\n  - from: docker.io", nil},
+		{"invalid mode flag", "", []string{"--backend-mode", "later"}},
+		{"zero shutdown timeout", "shutdownTimeout: 0s", nil},
+		{"bootstrap without tls", "bootstrap:\n  enabled: true\n  namespace: airgap", nil},
+		{"bootstrap without namespace", "", []string{"--bootstrap", "--tls-enabled", "--tls-cert", "tls.crt", "--tls-key", "tls.key"}},
+	}
+
+	for _, test := range tests {
+		args := append([]string{"--config", writeConfig(t, "config.yaml", test.content)}, test.args...)
+		_, err := LoadConfig(args)
+		assert.Error(t, err, test.name)
+	}
+}
+
+func TestConfigWatch(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "policy:\n  registries:\n    allowed: [mirror.internal]\n")
+	config, err := LoadConfig([]string{"--config", path, "--listen-address", "0.0.0.0:8443"})
+	assert.NoError(t, err)
+
+	applied := make(chan *Config, 10)
+	config.Watch(func(c *Config) error {
+		applied <- c
+		return nil
+	})
+	success := testutil.ToFloat64(configReloads.WithLabelValues("success"))
+	failure := testutil.ToFloat64(configReloads.WithLabelValues("failure"))
+
+	assert.NoError(t, os.WriteFile(path, []byte("policy:\n  registries:\n    allowed: [mirror.internal, \"*.corp\"]\n"), 0o600))
+	select {
+	case c := <-applied:
+		assert.Equal(t, []string{"mirror.internal", "*.corp"}, c.Policy.Registries.Allowed)
+		assert.Equal(t, "0.0.0.0:8443", c.ListenAddr, "flags are reapplied")
+	case <-time.After(5 * time.Second):
+		t.Fatal("config was not reloaded")
+	}
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(configReloads.WithLabelValues("success")) > success
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, os.WriteFile(path, []byte("policy:\n  registries:\n    mode: block\n"), 0o600))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(configReloads.WithLabelValues("failure")) > failure
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, applied, 0, "invalid configs are not applied")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// IDigestCatalog resolves image tags to the digests they point to.
+type IDigestCatalog interface {
+	// Digest returns the digest of a tagged image, in the form
+	// algorithm:hex, or false if it is unknown.
+	Digest(image Image) (string, bool)
+}
+
+// FileCatalog is a digest catalog loaded from a YAML or JSON file mapping
+// tagged references to digests, for example the output of a mirror sync:
+//
+//	docker.io/nginx:1.25: sha256:593dac25b7733ffb7afe1a72649a43e574778bf025ad60514ef40f6b5d606247
+type FileCatalog struct {
+	digests map[string]string
+}
+
+func NewFileCatalog(path string) (*FileCatalog, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]string{}
+	if err := yaml.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse digest catalog %s: %w", path, err)
+	}
+
+	catalog := &FileCatalog{digests: map[string]string{}}
+	for ref, digest := range entries {
+		if err := validateDigest(digest); err != nil {
+			return nil, fmt.Errorf("invalid digest for %s in %s: %w", ref, path, err)
+		}
+		image, err := NewImage(ref)
+		if err != nil {
+			return nil, fmt.Errorf("invalid catalog entry in %s: %w", path, err)
+		}
+		catalog.digests[image.Name()] = digest
+	}
+	return catalog, nil
+}
+
+// NewDigestCatalog returns the file catalog when one is configured, or
+// nil. Digests are never taken from the inventory, whose references are
+// submitted by users of any namespace. With mirror rules configured,
+// images are also looked up by their mirrored name.
+func NewDigestCatalog(config ConfigDigest, mirror ConfigMirror) (IDigestCatalog, error) {
+	if config.CatalogFile == "" {
+		return nil, nil
+	}
+	catalog, err := NewFileCatalog(config.CatalogFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(mirror.Rules) == 0 {
+		return catalog, nil
+	}
+	return &MirroredCatalog{catalog: catalog, mirror: NewMirror(mirror)}, nil
+}
+
+// MirroredCatalog resolves images by their source name and then by their
+// mirrored name. A catalog written by a mirror sync lists the images by
+// the name they have on the mirror.
+type MirroredCatalog struct {
+	catalog IDigestCatalog
+	mirror  *Mirror
+}
+
+func (c *MirroredCatalog) Digest(image Image) (string, bool) {
+	if digest, ok := c.catalog.Digest(image); ok {
+		return digest, true
+	}
+	if mirrored, ok := c.mirror.Rewrite(image); ok {
+		return c.catalog.Digest(mirrored)
+	}
+	return "", false
+}
+
+func (c *FileCatalog) Digest(image Image) (string, bool) {
+	digest, ok := c.digests[image.Name()]
+	return digest, ok
+}
+
+// withDigest returns the image pinned to a digest of the form
+// algorithm:hex.
+func (i Image) withDigest(digest string) Image {
+	i.digestHash, i.digest, _ = strings.Cut(digest, ":")
+	return i
+}
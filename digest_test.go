@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	nginxDigest    = "sha256:593dac25b7733ffb7afe1a72649a43e574778bf025ad60514ef40f6b5d606247"
+	perlDigest     = "sha256:1b624e3e6af841b907b1f5747b6f29ccb5ccb422f9e881eae82bd4b8b72cb7a1"
+	digestsCatalog = `
+docker.io/library/nginx:1.25: ` + nginxDigest + `
+perl:5.34.0: ` + perlDigest + `
+`
+)
+
+func writeTestCatalog(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "digests.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestFileCatalog(t *testing.T) {
+	catalog, err := NewFileCatalog(writeTestCatalog(t, digestsCatalog))
+	assert.NoError(t, err)
+
+	digest, ok := catalog.Digest(MustImage("nginx:1.25"))
+	assert.True(t, ok)
+	assert.Equal(t, nginxDigest, digest)
+
+	digest, ok = catalog.Digest(MustImage("docker.io/library/perl:5.34.0"))
+	assert.True(t, ok)
+	assert.Equal(t, perlDigest, digest)
+
+	_, ok = catalog.Digest(MustImage("nginx:1.24"))
+	assert.False(t, ok)
+
+	_, err = NewFileCatalog(writeTestCatalog(t, "nginx:1.25: latest\n"))
+	assert.Error(t, err)
+}
+
+func TestHandlePostMutatePin(t *testing.T) {
+	catalog, err := NewFileCatalog(writeTestCatalog(t, digestsCatalog))
+	assert.NoError(t, err)
+
+	s := &ApiServerCommon{
+		config: &Config{},
+		mutator: &Mutator{
+			mirror:  testMirror(t, "docker.io=mirror.internal/docker.io"),
+			catalog: catalog,
+			pin:     true,
+		},
+	}
+
+	response := postMutate(t, s, v1Job)
+	patches := []PatchOperation{}
+	assert.NoError(t, json.Unmarshal(response.Patch, &patches))
+	assert.Equal(t, []PatchOperation{
+		{"replace", "/spec/template/spec/containers/0/image", "mirror.internal/docker.io/library/perl:5.34.0@" + perlDigest},
+	}, patches)
+
+	// Without a mirror rule only images with a known digest are patched.
+	s.mutator.mirror = nil
+	response = postMutate(t, s, v1Pod)
+	assert.Nil(t, response.Patch)
+}
+
+func TestHandlePostValidateRequireDigest(t *testing.T) {
+	catalog, err := NewFileCatalog(writeTestCatalog(t, digestsCatalog))
+	assert.NoError(t, err)
+
+	s := &ApiServerCommon{
+		config: &Config{},
+		policy: NewPolicy(ConfigPolicy{
+			Digests: ConfigDigestPolicy{
+				Mode:     PolicyModeEnforce,
+				Required: true,
+			},
+		}, catalog, nil, nil),
+	}
+
+	response := decodeResponse(t, postValidate(t, s, v1Job).Body.Bytes())
+	assert.True(t, response.Allowed)
+
+	response = decodeResponse(t, postValidate(t, s, v1Pod).Body.Bytes())
+	assert.False(t, response.Allowed)
+	assert.Equal(t, "images violate the airgap policy: "+
+		"container init image docker.io/library/busybox:1.28: image is not pinned to a digest and no digest is known for its tag; "+
+		"container podinfo image ghcr.io/stefanprodan/podinfo:6.3.6: image is not pinned to a digest and no digest is known for its tag",
+		response.Result.Message)
+}
+
+func TestDigestCatalogMirror(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	s := &ApiServerCommon{config: &Config{}, backend: store, inventory: store}
+	config := &Config{
+		Policy: ConfigPolicy{
+			Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce},
+			Digests:    ConfigDigestPolicy{Mode: PolicyModeEnforce, Required: true},
+			Failure:    FailurePolicyFail,
+		},
+		Mirror: ConfigMirror{Rules: []ConfigMirrorRule{{From: "docker.io", To: "mirror.internal/docker.io"}}},
+		Digest: ConfigDigest{Pin: true},
+	}
+	assert.NoError(t, s.Reload(config))
+
+	// Digests submitted by users are recorded in the inventory but never
+	// used to resolve tags.
+	assert.NoError(t, store.Send([]Report{{Namespace: "tenant", Kind: "Job", Name: "pi", Images: []Image{
+		MustImage("mirror.internal/docker.io/library/perl:5.34.0@" + perlDigest),
+	}}}))
+	patches := []PatchOperation{}
+	assert.NoError(t, json.Unmarshal(postMutate(t, s, v1Job).Patch, &patches))
+	assert.Equal(t, []PatchOperation{
+		{"replace", "/spec/template/spec/containers/0/image", "mirror.internal/docker.io/library/perl:5.34.0"},
+	}, patches)
+	assert.False(t, decodeResponse(t, postValidate(t, s, v1Job).Body.Bytes()).Allowed)
+
+	// The mirror sync lists the image by its mirrored reference.
+	config.Digest.CatalogFile = writeTestCatalog(t, "mirror.internal/docker.io/library/perl:5.34.0: "+perlDigest+"\n")
+	assert.NoError(t, s.Reload(config))
+
+	patches = []PatchOperation{}
+	assert.NoError(t, json.Unmarshal(postMutate(t, s, v1Job).Patch, &patches))
+	assert.Equal(t, []PatchOperation{
+		{"replace", "/spec/template/spec/containers/0/image", "mirror.internal/docker.io/library/perl:5.34.0@" + perlDigest},
+	}, patches)
+
+	response := decodeResponse(t, postValidate(t, s, v1Job).Body.Bytes())
+	assert.True(t, response.Allowed, "the digest of the source image is resolved through its mirror")
+}
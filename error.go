@@ -1,5 +1,11 @@
 package main
 
+import "errors"
+
+// ErrUnknownKind is returned when no handler or rule can extract images
+// from the kind of an admission request.
+var ErrUnknownKind = errors.New("resource kind not implemented")
+
 type ApiError struct {
 	code  int
 	error string
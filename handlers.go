@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	appsv1 "k8s.io/api/apps/v1"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	appsv1beta2 "k8s.io/api/apps/v1beta2"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	podSpecPath     = "/spec"
+	podTemplatePath = "/spec/template/spec"
+	jobTemplatePath = "/spec/jobTemplate/spec/template/spec"
+)
+
+// PodSpecPath is a pod spec found in an object along with the JSON
+// pointer to it.
+type PodSpecPath struct {
+	spec *corev1.PodSpec
+	path string
+}
+
+// ResourceHandler returns the pod specs inside a raw object.
+type ResourceHandler func(raw []byte) ([]PodSpecPath, error)
+
+// ResourceRegistry holds the resource handlers by kind.
+type ResourceRegistry struct {
+	handlers map[schema.GroupVersionKind]ResourceHandler
+}
+
+// resourceHandlers are the kinds supported out of the box. A kind is added
+// by registering its group, version and kind with the path of its pod
+// spec.
+var resourceHandlers = NewResourceRegistry(
+	podSpecHandler(corev1.SchemeGroupVersion.WithKind("Pod"), podSpecPath, func(o *corev1.Pod) *corev1.PodSpec { return &o.Spec }),
+	podSpecHandler(corev1.SchemeGroupVersion.WithKind("ReplicationController"), podTemplatePath, func(o *corev1.ReplicationController) *corev1.PodSpec {
+		if o.Spec.Template == nil {
+			return nil
+		}
+		return &o.Spec.Template.Spec
+	}),
+	podSpecHandler(corev1.SchemeGroupVersion.WithKind("PodTemplate"), "/template/spec", func(o *corev1.PodTemplate) *corev1.PodSpec { return &o.Template.Spec }),
+	resourceHandler(corev1.SchemeGroupVersion.WithKind("EphemeralContainers"), handleEphemeralContainers),
+
+	podSpecHandler(batchv1.SchemeGroupVersion.WithKind("Job"), podTemplatePath, func(o *batchv1.Job) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(batchv1.SchemeGroupVersion.WithKind("CronJob"), jobTemplatePath, func(o *batchv1.CronJob) *corev1.PodSpec { return &o.Spec.JobTemplate.Spec.Template.Spec }),
+	podSpecHandler(batchv1beta1.SchemeGroupVersion.WithKind("CronJob"), jobTemplatePath, func(o *batchv1beta1.CronJob) *corev1.PodSpec { return &o.Spec.JobTemplate.Spec.Template.Spec }),
+
+	podSpecHandler(appsv1.SchemeGroupVersion.WithKind("Deployment"), podTemplatePath, func(o *appsv1.Deployment) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(appsv1.SchemeGroupVersion.WithKind("DaemonSet"), podTemplatePath, func(o *appsv1.DaemonSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(appsv1.SchemeGroupVersion.WithKind("StatefulSet"), podTemplatePath, func(o *appsv1.StatefulSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(appsv1.SchemeGroupVersion.WithKind("ReplicaSet"), podTemplatePath, func(o *appsv1.ReplicaSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+
+	podSpecHandler(appsv1beta2.SchemeGroupVersion.WithKind("Deployment"), podTemplatePath, func(o *appsv1beta2.Deployment) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(appsv1beta2.SchemeGroupVersion.WithKind("DaemonSet"), podTemplatePath, func(o *appsv1beta2.DaemonSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(appsv1beta2.SchemeGroupVersion.WithKind("StatefulSet"), podTemplatePath, func(o *appsv1beta2.StatefulSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(appsv1beta2.SchemeGroupVersion.WithKind("ReplicaSet"), podTemplatePath, func(o *appsv1beta2.ReplicaSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+
+	podSpecHandler(appsv1beta1.SchemeGroupVersion.WithKind("Deployment"), podTemplatePath, func(o *appsv1beta1.Deployment) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(appsv1beta1.SchemeGroupVersion.WithKind("StatefulSet"), podTemplatePath, func(o *appsv1beta1.StatefulSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+
+	podSpecHandler(extensionsv1beta1.SchemeGroupVersion.WithKind("Deployment"), podTemplatePath, func(o *extensionsv1beta1.Deployment) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(extensionsv1beta1.SchemeGroupVersion.WithKind("DaemonSet"), podTemplatePath, func(o *extensionsv1beta1.DaemonSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+	podSpecHandler(extensionsv1beta1.SchemeGroupVersion.WithKind("ReplicaSet"), podTemplatePath, func(o *extensionsv1beta1.ReplicaSet) *corev1.PodSpec { return &o.Spec.Template.Spec }),
+)
+
+// registration pairs a kind with its handler.
+type registration struct {
+	gvk     schema.GroupVersionKind
+	handler ResourceHandler
+}
+
+func NewResourceRegistry(registrations ...registration) *ResourceRegistry {
+	registry := &ResourceRegistry{
+		handlers: map[schema.GroupVersionKind]ResourceHandler{},
+	}
+	for _, r := range registrations {
+		registry.Register(r.gvk, r.handler)
+	}
+	return registry
+}
+
+func (r *ResourceRegistry) Register(gvk schema.GroupVersionKind, handler ResourceHandler) {
+	r.handlers[gvk] = handler
+}
+
+func (r *ResourceRegistry) Lookup(gvk metav1.GroupVersionKind) (ResourceHandler, bool) {
+	handler, ok := r.handlers[schema.GroupVersionKind{Group: gvk.Group, Version: gvk.Version, Kind: gvk.Kind}]
+	return handler, ok
+}
+
+// Kinds returns every registered kind.
+func (r *ResourceRegistry) Kinds() []schema.GroupVersionKind {
+	kinds := make([]schema.GroupVersionKind, 0, len(r.handlers))
+	for gvk := range r.handlers {
+		kinds = append(kinds, gvk)
+	}
+	return kinds
+}
+
+func resourceHandler(gvk schema.GroupVersionKind, handler ResourceHandler) registration {
+	return registration{gvk: gvk, handler: handler}
+}
+
+// podSpecHandler registers a typed kind holding a single pod spec at path.
+func podSpecHandler[T any, PT interface {
+	*T
+	runtime.Object
+}](gvk schema.GroupVersionKind, path string, spec func(PT) *corev1.PodSpec) registration {
+	return resourceHandler(gvk, func(raw []byte) ([]PodSpecPath, error) {
+		resource := PT(new(T))
+		if _, _, err := deserializer.Decode(raw, nil, resource); err != nil {
+			return nil, NewApiError(http.StatusBadRequest, err.Error())
+		}
+		podSpec := spec(resource)
+		if podSpec == nil {
+			return nil, nil
+		}
+		return []PodSpecPath{{spec: podSpec, path: path}}, nil
+	})
+}
+
+// ephemeralContainers is the object of the pods/ephemeralcontainers
+// subresource on clusters before 1.22, newer clusters send the Pod.
+type ephemeralContainers struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	EphemeralContainers []corev1.EphemeralContainer `json:"ephemeralContainers,omitempty"`
+}
+
+func handleEphemeralContainers(raw []byte) ([]PodSpecPath, error) {
+	resource := ephemeralContainers{}
+	if err := json.Unmarshal(raw, &resource); err != nil {
+		return nil, NewApiError(http.StatusBadRequest, err.Error())
+	}
+	// The containers sit at the root of the object rather than in a spec.
+	spec := &corev1.PodSpec{EphemeralContainers: resource.EphemeralContainers}
+	return []PodSpecPath{{spec: spec, path: ""}}, nil
+}
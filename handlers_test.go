@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/imperialops/airgap-webhook/admission"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	v1beta1CronJob = []byte(`apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: hello
+spec:
+  schedule: "* * * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: hello
+            image: busybox:1.28
+          restartPolicy: OnFailure`)
+	v1beta2Deployment = []byte(`apiVersion: apps/v1beta2
+kind: Deployment
+metadata:
+  name: nginx-deployment
+spec:
+  selector:
+    matchLabels:
+      app: nginx
+  template:
+    metadata:
+      labels:
+        app: nginx
+    spec:
+      containers:
+      - name: nginx
+        image: nginx:1.25`)
+	v1ReplicationController = []byte(`apiVersion: v1
+kind: ReplicationController
+metadata:
+  name: nginx
+spec:
+  replicas: 3
+  template:
+    metadata:
+      labels:
+        app: nginx
+    spec:
+      containers:
+      - name: nginx
+        image: nginx:1.25`)
+)
+
+func TestResourceHandlers(t *testing.T) {
+	tests := []struct {
+		resource []byte
+		expected []Container
+	}{
+		{v1beta1CronJob, []Container{
+			{name: "hello", path: "/spec/jobTemplate/spec/template/spec/containers/0/image", ref: "busybox:1.28", image: MustImage("busybox:1.28")},
+		}},
+		{v1beta2Deployment, []Container{
+			{name: "nginx", path: "/spec/template/spec/containers/0/image", ref: "nginx:1.25", image: MustImage("nginx:1.25")},
+		}},
+		{v1ReplicationController, []Container{
+			{name: "nginx", path: "/spec/template/spec/containers/0/image", ref: "nginx:1.25", image: MustImage("nginx:1.25")},
+		}},
+	}
+
+	for _, test := range tests {
+		bytes, err := admission.CreateAdmissionReviewRequest(test.resource, "create", "imperialops", []string{})
+		assert.NoError(t, err)
+		admissionReview := MustAdmissionReview(bytes)
+		assert.NoError(t, admissionReview.handleResource())
+		assert.Equal(t, test.expected, admissionReview.containers)
+	}
+}
+
+func TestResourceRegistry(t *testing.T) {
+	gvk := schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Widget"}
+	registry := NewResourceRegistry()
+
+	_, ok := registry.Lookup(metav1.GroupVersionKind(gvk))
+	assert.False(t, ok)
+
+	registry.Register(gvk, func(raw []byte) ([]PodSpecPath, error) {
+		return nil, nil
+	})
+	_, ok = registry.Lookup(metav1.GroupVersionKind(gvk))
+	assert.True(t, ok)
+	assert.Equal(t, []schema.GroupVersionKind{gvk}, registry.Kinds())
+
+	// Kinds are matched on their group too.
+	_, ok = resourceHandlers.Lookup(metav1.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "Deployment"})
+	assert.False(t, ok)
+	_, ok = resourceHandlers.Lookup(metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"})
+	assert.True(t, ok)
+}
@@ -1,48 +1,201 @@
 package main
 
-import "strings"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultRegistry    = "docker.io"
+	legacyRegistry     = "index.docker.io"
+	officialRepository = "library"
+	defaultTag         = "latest"
+	maxNameLength      = 255
+)
+
+// Grammar of image references as specified by the distribution project,
+// https://github.com/distribution/reference/blob/main/reference.go
+var (
+	alphaNumeric    = `[a-z0-9]+`
+	separator       = `(?:[._]|__|[-]+)`
+	pathComponent   = alphaNumeric + `(?:` + separator + alphaNumeric + `)*`
+	domainComponent = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+	domainName      = domainComponent + `(?:\.` + domainComponent + `)*`
+	ipv6Address     = `\[(?:[a-fA-F0-9:]+)\]`
+	host            = `(?:` + domainName + `|` + ipv6Address + `)`
+	domain          = host + `(?::[0-9]+)?`
+	tag             = `[\w][\w.-]{0,127}`
+	digest          = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+
+	domainRegexp = regexp.MustCompile(`^` + domain + `$`)
+	pathRegexp   = regexp.MustCompile(`^` + pathComponent + `(?:/` + pathComponent + `)*$`)
+	tagRegexp    = regexp.MustCompile(`^` + tag + `$`)
+	digestRegexp = regexp.MustCompile(`^` + digest + `$`)
+
+	// lowerHexRegexp matches the encoding of the registered algorithms,
+	// which the OCI image spec restricts to lowercase hex.
+	lowerHexRegexp = regexp.MustCompile(`^[0-9a-f]+$`)
+
+	// digestLengths holds the hex length of the registered algorithms.
+	digestLengths = map[string]int{
+		"sha256": 64,
+		"sha384": 96,
+		"sha512": 128,
+	}
+)
 
 type Image struct {
-	registry   string `json:"registry"`
-	repository string `json:"repository"`
-	tag        string `json:"tag"`
-	digestHash string `json:"hash"`
-	digest     string `json:"digest"`
+	registry   string
+	repository string
+	tag        string
+	digestHash string
+	digest     string
+}
+
+// imageJson is the wire representation of an Image.
+type imageJson struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	DigestHash string `json:"hash,omitempty"`
+	Digest     string `json:"digest,omitempty"`
 }
 
-func NewImage(i string) Image {
+// NewImage parses an image reference and normalizes it the way container
+// runtimes do: references without a registry are pulled from docker.io,
+// single component docker.io repositories live under library/ and
+// references with neither a tag nor a digest use the latest tag.
+func NewImage(ref string) (Image, error) {
 	image := Image{}
-	if i == "" {
-		return image
+	if ref == "" {
+		return image, errors.New("image reference is empty")
 	}
 
-	// hangle digest
-	dirtyTag, dirtyDigest, foundDigest := strings.Cut(i, "@")
+	// handle digest
+	rest, dirtyDigest, foundDigest := strings.Cut(ref, "@")
 	if foundDigest {
-		digestParts := strings.Split(dirtyDigest, ":")
-		image.digestHash = digestParts[0]
-		image.digest = digestParts[1]
-	} else {
-		image.digestHash = ""
-		image.digest = ""
+		if err := validateDigest(dirtyDigest); err != nil {
+			return Image{}, fmt.Errorf("invalid image reference %q: %w", ref, err)
+		}
+		image.digestHash, image.digest, _ = strings.Cut(dirtyDigest, ":")
 	}
 
-	// handle tag
-	name, tag, foundTag := strings.Cut(dirtyTag, ":")
-	if foundTag {
-		image.tag = tag
-	} else {
-		image.tag = "latest"
+	// handle tag, a colon followed by a slash belongs to a registry port
+	name := rest
+	if i := strings.LastIndex(rest, ":"); i > strings.LastIndex(rest, "/") {
+		name = rest[:i]
+		image.tag = rest[i+1:]
+		if !tagRegexp.MatchString(image.tag) {
+			return Image{}, fmt.Errorf("invalid image reference %q: invalid tag %q", ref, image.tag)
+		}
+	}
+	if len(name) > maxNameLength {
+		return Image{}, fmt.Errorf("invalid image reference %q: name is longer than %d characters", ref, maxNameLength)
 	}
 
 	// handle registry and repository
-	nameParts := strings.Split(name, "/")
-	if strings.Contains(nameParts[0], ".") {
-		image.registry = nameParts[0]
-		image.repository = strings.Join(nameParts[1:], "/")
-	} else {
-		image.registry = "docker.io"
-		image.repository = strings.Join(nameParts, "/")
+	registry, repository, foundRegistry := strings.Cut(name, "/")
+	if !foundRegistry || !isRegistry(registry) {
+		registry = defaultRegistry
+		repository = name
+	}
+	if registry == legacyRegistry {
+		registry = defaultRegistry
+	}
+	if !domainRegexp.MatchString(registry) {
+		return Image{}, fmt.Errorf("invalid image reference %q: invalid registry %q", ref, registry)
+	}
+	if !pathRegexp.MatchString(repository) {
+		return Image{}, fmt.Errorf("invalid image reference %q: invalid repository %q, repositories must be lowercase", ref, repository)
+	}
+	if registry == defaultRegistry && !strings.Contains(repository, "/") {
+		repository = officialRepository + "/" + repository
+	}
+	image.registry = registry
+	image.repository = repository
+
+	if image.tag == "" && image.digest == "" {
+		image.tag = defaultTag
+	}
+	return image, nil
+}
+
+func MustImage(ref string) Image {
+	image, err := NewImage(ref)
+	if err != nil {
+		log.Panicf("could not parse image: %s", err)
 	}
 	return image
 }
+
+// isRegistry reports whether the first component of a reference is a
+// registry rather than part of the repository.
+func isRegistry(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost" || strings.ToLower(component) != component
+}
+
+func validateDigest(digest string) error {
+	if !digestRegexp.MatchString(digest) {
+		return fmt.Errorf("invalid digest %q", digest)
+	}
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	length, ok := digestLengths[algorithm]
+	if !ok {
+		return nil
+	}
+	if len(hex) != length {
+		return fmt.Errorf("invalid %s digest length %d, expected %d", algorithm, len(hex), length)
+	}
+	if !lowerHexRegexp.MatchString(hex) {
+		return fmt.Errorf("invalid %s digest %q, expected lowercase hex", algorithm, hex)
+	}
+	return nil
+}
+
+// Name returns the fully qualified reference of the image without its
+// digest.
+func (i Image) Name() string {
+	s := i.registry + "/" + i.repository
+	if i.tag != "" {
+		s += ":" + i.tag
+	}
+	return s
+}
+
+// String returns the fully qualified reference of the image.
+func (i Image) String() string {
+	s := i.Name()
+	if i.digest != "" {
+		s += "@" + i.digestHash + ":" + i.digest
+	}
+	return s
+}
+
+func (i Image) MarshalJSON() ([]byte, error) {
+	return json.Marshal(imageJson{
+		Registry:   i.registry,
+		Repository: i.repository,
+		Tag:        i.tag,
+		DigestHash: i.digestHash,
+		Digest:     i.digest,
+	})
+}
+
+func (i *Image) UnmarshalJSON(b []byte) error {
+	var v imageJson
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*i = Image{
+		registry:   v.Registry,
+		repository: v.Repository,
+		tag:        v.Tag,
+		digestHash: v.DigestHash,
+		digest:     v.Digest,
+	}
+	return nil
+}
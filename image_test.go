@@ -14,7 +14,7 @@ func TestNewImage(t *testing.T) {
 		{"nginx",
 			Image{
 				registry:   "docker.io",
-				repository: "nginx",
+				repository: "library/nginx",
 				tag:        "latest",
 				digestHash: "",
 				digest:     "",
@@ -23,8 +23,8 @@ func TestNewImage(t *testing.T) {
 		{"nginx@sha256:f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1",
 			Image{
 				registry:   "docker.io",
-				repository: "nginx",
-				tag:        "latest",
+				repository: "library/nginx",
+				tag:        "",
 				digestHash: "sha256",
 				digest:     "f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1",
 			},
@@ -47,10 +47,143 @@ func TestNewImage(t *testing.T) {
 				digest:     "1b624e3e6af841b907b1f5747b6f29ccb5ccb422f9e881eae82bd4b8b72cb7a1",
 			},
 		},
+		{"localhost:5000/app",
+			Image{
+				registry:   "localhost:5000",
+				repository: "app",
+				tag:        "latest",
+			},
+		},
+		{"localhost/app:v1",
+			Image{
+				registry:   "localhost",
+				repository: "app",
+				tag:        "v1",
+			},
+		},
+		{"registry:5000/team/app:1.0",
+			Image{
+				registry:   "registry:5000",
+				repository: "team/app",
+				tag:        "1.0",
+			},
+		},
+		{"[::1]:5000/app:1.0",
+			Image{
+				registry:   "[::1]:5000",
+				repository: "app",
+				tag:        "1.0",
+			},
+		},
+		{"docker.io/nginx",
+			Image{
+				registry:   "docker.io",
+				repository: "library/nginx",
+				tag:        "latest",
+			},
+		},
+		{"index.docker.io/bitnami/redis:7.0",
+			Image{
+				registry:   "docker.io",
+				repository: "bitnami/redis",
+				tag:        "7.0",
+			},
+		},
+		{"quay.io/nginx",
+			Image{
+				registry:   "quay.io",
+				repository: "nginx",
+				tag:        "latest",
+			},
+		},
+		{"ghcr.io/a__b/c-d--e.f_g:V1_2.3-rc",
+			Image{
+				registry:   "ghcr.io",
+				repository: "a__b/c-d--e.f_g",
+				tag:        "V1_2.3-rc",
+			},
+		},
 	}
 
 	for _, test := range tests {
-		image := NewImage(test.image)
+		image, err := NewImage(test.image)
+		assert.NoError(t, err, test.image)
 		assert.Equal(t, image, test.expected, "got %v, expected %v", image, test.expected)
 	}
 }
+
+func TestNewImageErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"app@sha256",
+		"app@sha256:",
+		"app@sha256:abc",
+		"app@sha256:f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b",
+		"app@sha256:F2FEE5C7194CBBFB9D2711FA5DE094C797A42A51AA42B0C8EE8CA31547C872B1",
+		"app@md5:zzzz5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1",
+		"Nginx",
+		"docker.io/Library/nginx",
+		"nginx:",
+		"nginx:-tag",
+		"nginx:" + string(make([]byte, 129)),
+		"ghcr.io//app",
+		"ghcr.io/app/",
+		"-registry.io/app",
+		"app name",
+		"ghcr.io/" + string(make([]byte, 256)),
+	}
+
+	for _, test := range tests {
+		_, err := NewImage(test)
+		assert.Error(t, err, test)
+	}
+}
+
+func TestImageString(t *testing.T) {
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"nginx", "docker.io/library/nginx:latest"},
+		{"nginx@sha256:f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1", "docker.io/library/nginx@sha256:f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1"},
+		{"localhost:5000/app:v1", "localhost:5000/app:v1"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, MustImage(test.image).String())
+	}
+}
+
+func FuzzNewImage(f *testing.F) {
+	seeds := []string{
+		"nginx",
+		"nginx:1.25",
+		"docker.io/library/nginx:1.25@sha256:f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1",
+		"localhost:5000/app",
+		"[::1]:5000/app:1.0",
+		"app@sha256",
+		"app@sha256:",
+		"a:b@c:d",
+		"app@sha256:F2FEE5C7194CBBFB9D2711FA5DE094C797A42A51AA42B0C8EE8CA31547C872B1",
+		"registry:5000/team/app:1.0@sha512:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, ref string) {
+		image, err := NewImage(ref)
+		if err != nil {
+			return
+		}
+
+		// Normalized references must parse back to the same image.
+		reparsed, err := NewImage(image.String())
+		if err != nil {
+			t.Fatalf("normalized reference %q of %q does not parse: %s", image.String(), ref, err)
+		}
+		if reparsed != image {
+			t.Fatalf("normalized reference %q of %q parses to %v, expected %v", image.String(), ref, reparsed, image)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// IInventory is implemented by backends that can be queried for the
+// images they have stored.
+type IInventory interface {
+	Images(filter ImageFilter) ([]ImageRecord, error)
+	Workload(workload Workload) (*WorkloadRecord, error)
+}
+
+// ImageFilter selects image records, empty fields match everything.
+type ImageFilter struct {
+	Registry   string
+	Repository string
+	Namespace  string
+	Tag        string
+	// Digest selects images with (true) or without (false) a digest.
+	Digest *bool
+}
+
+// ImagePage is a page of image records returned by the api.
+type ImagePage struct {
+	Items  []ImageRecord `json:"items"`
+	Total  int           `json:"total"`
+	Offset int           `json:"offset"`
+	Limit  int           `json:"limit"`
+}
+
+// inventoryOf returns the queryable inventory behind a backend, or nil if
+// the backend cannot be queried.
+func inventoryOf(backend IBackend) IInventory {
+	for backend != nil {
+		if inventory, ok := backend.(IInventory); ok {
+			return inventory
+		}
+		wrapper, ok := backend.(interface{ Unwrap() IBackend })
+		if !ok {
+			return nil
+		}
+		backend = wrapper.Unwrap()
+	}
+	return nil
+}
+
+// syncInventoryOf returns the inventory of a backend storing reports
+// before Send returns, or nil for queued backends.
+func syncInventoryOf(backend IBackend) IInventory {
+	inventory, _ := backend.(IInventory)
+	return inventory
+}
+
+func (f ImageFilter) Match(record ImageRecord) bool {
+	if f.Registry != "" && f.Registry != record.Image.registry {
+		return false
+	}
+	if f.Repository != "" && f.Repository != record.Image.repository {
+		return false
+	}
+	if f.Tag != "" && f.Tag != record.Image.tag {
+		return false
+	}
+	if f.Digest != nil && *f.Digest != (record.Image.digest != "") {
+		return false
+	}
+	if f.Namespace != "" {
+		for _, workload := range record.Workloads {
+			if workload.Namespace == f.Namespace {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (s *ApiServerCommon) registerInventoryRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/images", newApiFunc(s.handleImages))
+	mux.HandleFunc("/api/v1/images/", newApiFunc(s.handleImages))
+	mux.HandleFunc("/api/v1/workloads/", newApiFunc(s.handleWorkloads))
+}
+
+func (s *ApiServerCommon) handleImages(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return s.handleGetImages(w, r)
+	default:
+		return NewApiError(http.StatusMethodNotAllowed, fmt.Sprintf("%s method not allowed", r.Method))
+	}
+}
+
+func (s *ApiServerCommon) handleGetImages(w http.ResponseWriter, r *http.Request) error {
+	if s.inventory == nil {
+		return NewApiError(http.StatusNotImplemented, "inventory is not available with the configured backend")
+	}
+
+	query := r.URL.Query()
+	filter, err := newImageFilter(query)
+	if err != nil {
+		return err
+	}
+
+	// /api/v1/images/{registry}/{repository}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/images"), "/")
+	if path != "" {
+		registry, repository, found := strings.Cut(path, "/")
+		if !found || repository == "" {
+			return NewApiError(http.StatusNotFound, fmt.Sprintf("%s not found", r.URL.Path))
+		}
+		filter.Registry = registry
+		filter.Repository = repository
+	}
+
+	records, err := s.inventory.Images(filter)
+	if err != nil {
+		return err
+	}
+	if path != "" && len(records) == 0 {
+		return NewApiError(http.StatusNotFound, fmt.Sprintf("image %s not found", path))
+	}
+
+	if err := sortImageRecords(records, query.Get("sort")); err != nil {
+		return err
+	}
+	page, err := newImagePage(records, query)
+	if err != nil {
+		return err
+	}
+	return writeJson(w, http.StatusOK, page)
+}
+
+func (s *ApiServerCommon) handleWorkloads(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		return s.handleGetWorkload(w, r)
+	default:
+		return NewApiError(http.StatusMethodNotAllowed, fmt.Sprintf("%s method not allowed", r.Method))
+	}
+}
+
+func (s *ApiServerCommon) handleGetWorkload(w http.ResponseWriter, r *http.Request) error {
+	if s.inventory == nil {
+		return NewApiError(http.StatusNotImplemented, "inventory is not available with the configured backend")
+	}
+
+	// /api/v1/workloads/{namespace}/{kind}/{name}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/workloads"), "/"), "/")
+	if len(parts) != 3 {
+		return NewApiError(http.StatusNotFound, fmt.Sprintf("%s not found", r.URL.Path))
+	}
+
+	record, err := s.inventory.Workload(Workload{Namespace: parts[0], Kind: parts[1], Name: parts[2]})
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return NewApiError(http.StatusNotFound, fmt.Sprintf("workload %s not found", strings.Join(parts, "/")))
+	}
+	return writeJson(w, http.StatusOK, record)
+}
+
+func newImageFilter(query url.Values) (ImageFilter, error) {
+	filter := ImageFilter{
+		Registry:  query.Get("registry"),
+		Namespace: query.Get("namespace"),
+		Tag:       query.Get("tag"),
+	}
+	if v := query.Get("digest"); v != "" {
+		digest, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, NewApiError(http.StatusBadRequest, fmt.Sprintf("invalid digest filter %q", v))
+		}
+		filter.Digest = &digest
+	}
+	return filter, nil
+}
+
+// sortImageRecords orders records by lastSeen, or by -lastSeen for most
+// recent first. Records keep their stored order when no sort is given.
+func sortImageRecords(records []ImageRecord, by string) error {
+	switch by {
+	case "":
+	case "lastSeen":
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].LastSeen.Before(records[j].LastSeen)
+		})
+	case "-lastSeen":
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].LastSeen.After(records[j].LastSeen)
+		})
+	default:
+		return NewApiError(http.StatusBadRequest, fmt.Sprintf("invalid sort %q, expected lastSeen or -lastSeen", by))
+	}
+	return nil
+}
+
+func newImagePage(records []ImageRecord, query url.Values) (*ImagePage, error) {
+	offset, err := queryInt(query, "offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := queryInt(query, "limit", defaultPageLimit)
+	if err != nil {
+		return nil, err
+	}
+	if limit < 1 || limit > maxPageLimit {
+		return nil, NewApiError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageLimit))
+	}
+
+	page := &ImagePage{
+		Items:  []ImageRecord{},
+		Total:  len(records),
+		Offset: offset,
+		Limit:  limit,
+	}
+	if offset < len(records) {
+		end := offset + limit
+		if end > len(records) {
+			end = len(records)
+		}
+		page.Items = records[offset:end]
+	}
+	return page, nil
+}
+
+func queryInt(query url.Values, key string, def int) (int, error) {
+	v := query.Get(key)
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, NewApiError(http.StatusBadRequest, fmt.Sprintf("invalid %s %q", key, v))
+	}
+	return i, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestInventoryServer(t *testing.T) *ApiServerCommon {
+	store, now := newTestBoltStore(t)
+	reports := []Report{
+		{Namespace: "default", Kind: "Deployment", Name: "web", Operation: "CREATE", Images: []Image{
+			MustImage("nginx:stable@sha256:f3c37d8a26f7a7d8a547470c58733f270bcccb7e785da17af81ec41576170da8"),
+		}},
+		{Namespace: "monitoring", Kind: "DaemonSet", Name: "fluentd", Operation: "CREATE", Images: []Image{
+			MustImage("quay.io/fluentd_elasticsearch/fluentd:v2.5.2"),
+		}},
+		{Namespace: "default", Kind: "Job", Name: "pi", Operation: "CREATE", Images: []Image{
+			MustImage("nginx:1.25"),
+			MustImage("perl:5.34.0"),
+		}},
+	}
+	for _, report := range reports {
+		*now = now.Add(time.Minute)
+		assert.NoError(t, store.Send([]Report{report}))
+	}
+
+	return &ApiServerCommon{config: &Config{}, backend: store, inventory: inventoryOf(store)}
+}
+
+func getInventory(t *testing.T, s *ApiServerCommon, target string, v any) int {
+	w := httptest.NewRecorder()
+	s.newApiServeMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	if w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w.Code
+}
+
+func imagePageRefs(page ImagePage) []string {
+	refs := []string{}
+	for _, record := range page.Items {
+		refs = append(refs, record.Image.String())
+	}
+	return refs
+}
+
+func TestGetImages(t *testing.T) {
+	s := newTestInventoryServer(t)
+
+	tests := []struct {
+		target   string
+		expected []string
+		total    int
+	}{
+		{"/api/v1/images?sort=-lastSeen", []string{
+			"docker.io/library/nginx:1.25",
+			"docker.io/library/perl:5.34.0",
+			"quay.io/fluentd_elasticsearch/fluentd:v2.5.2",
+			"docker.io/library/nginx:stable@sha256:f3c37d8a26f7a7d8a547470c58733f270bcccb7e785da17af81ec41576170da8",
+		}, 4},
+		{"/api/v1/images?registry=quay.io", []string{
+			"quay.io/fluentd_elasticsearch/fluentd:v2.5.2",
+		}, 1},
+		{"/api/v1/images?namespace=default&digest=false&sort=lastSeen", []string{
+			"docker.io/library/nginx:1.25",
+			"docker.io/library/perl:5.34.0",
+		}, 2},
+		{"/api/v1/images?tag=stable&digest=true", []string{
+			"docker.io/library/nginx:stable@sha256:f3c37d8a26f7a7d8a547470c58733f270bcccb7e785da17af81ec41576170da8",
+		}, 1},
+		{"/api/v1/images?sort=lastSeen&offset=1&limit=2", []string{
+			"quay.io/fluentd_elasticsearch/fluentd:v2.5.2",
+			"docker.io/library/nginx:1.25",
+		}, 4},
+		{"/api/v1/images?offset=10", []string{}, 4},
+		{"/api/v1/images/docker.io/library/nginx?sort=lastSeen", []string{
+			"docker.io/library/nginx:stable@sha256:f3c37d8a26f7a7d8a547470c58733f270bcccb7e785da17af81ec41576170da8",
+			"docker.io/library/nginx:1.25",
+		}, 2},
+		{"/api/v1/images/quay.io/fluentd_elasticsearch/fluentd", []string{
+			"quay.io/fluentd_elasticsearch/fluentd:v2.5.2",
+		}, 1},
+	}
+
+	for _, test := range tests {
+		page := ImagePage{}
+		assert.Equal(t, http.StatusOK, getInventory(t, s, test.target, &page), test.target)
+		assert.Equal(t, test.expected, imagePageRefs(page), test.target)
+		assert.Equal(t, test.total, page.Total, test.target)
+	}
+}
+
+func TestGetImagesErrors(t *testing.T) {
+	s := newTestInventoryServer(t)
+
+	tests := []struct {
+		target string
+		code   int
+	}{
+		{"/api/v1/images?digest=maybe", http.StatusBadRequest},
+		{"/api/v1/images?sort=name", http.StatusBadRequest},
+		{"/api/v1/images?limit=0", http.StatusBadRequest},
+		{"/api/v1/images?offset=-1", http.StatusBadRequest},
+		{"/api/v1/images/docker.io", http.StatusNotFound},
+		{"/api/v1/images/docker.io/redis", http.StatusNotFound},
+		{"/api/v1/workloads/default/Job", http.StatusNotFound},
+		{"/api/v1/workloads/default/Job/missing", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.code, getInventory(t, s, test.target, nil), test.target)
+	}
+
+	s = &ApiServerCommon{config: &Config{}, backend: &fakeBackend{}}
+	assert.Equal(t, http.StatusNotImplemented, getInventory(t, s, "/api/v1/images", nil))
+}
+
+func TestGetWorkload(t *testing.T) {
+	s := newTestInventoryServer(t)
+
+	record := WorkloadRecord{}
+	assert.Equal(t, http.StatusOK, getInventory(t, s, "/api/v1/workloads/default/Job/pi", &record))
+	assert.Equal(t, Workload{Namespace: "default", Kind: "Job", Name: "pi"}, record.Workload)
+	assert.Equal(t, []Image{MustImage("nginx:1.25"), MustImage("perl:5.34.0")}, record.Images)
+}
+
+func TestInventoryNotOnAdmissionListener(t *testing.T) {
+	s := newTestInventoryServer(t)
+	for _, target := range []string{"/api/v1/images", "/api/v1/workloads/default/Job/pi"} {
+		w := httptest.NewRecorder()
+		s.newServeMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, target)
+	}
+}
+
+func TestInventoryOf(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	queue, err := NewQueue(store, testQueueConfig(""))
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	assert.Equal(t, store, inventoryOf(queue))
+	assert.Nil(t, inventoryOf(&fakeBackend{}))
+	assert.Nil(t, inventoryOf(nil))
+}
@@ -1,11 +1,46 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/pflag"
+)
+
 func main() {
 	config, err := NewConfig()
+	if errors.Is(err, pflag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	server := NewApiServer(config)
-	server.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if config.Bootstrap.Enabled {
+		client, err := NewKubeClient()
+		if err != nil {
+			panic(err)
+		}
+		if err := Bootstrap(ctx, client, config); err != nil {
+			panic(err)
+		}
+	}
+
+	server, err := NewApiServer(config)
+	if err != nil {
+		panic(err)
+	}
+	config.Watch(server.Reload)
+	if err := server.Run(ctx); err != nil {
+		log.Printf("shutdown: %s", err)
+		os.Exit(1)
+	}
+	log.Printf("shutdown complete")
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics is the registry served on /metrics.
+var metrics = prometheus.NewRegistry()
+
+var (
+	reviewsSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "airgap_webhook_reviews_skipped_total",
+		Help: "Admission reviews that skipped the policy and inventory, by kind and reason: unchanged_images for updates keeping the images, subresource for subresources that cannot change them.",
+	}, []string{"kind", "reason"})
+	configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "airgap_webhook_config_reloads_total",
+		Help: "Config file reloads by result, success or failure.",
+	}, []string{"result"})
+	certReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "airgap_webhook_tls_cert_reloads_total",
+		Help: "Reloads of the serving tls key pair by result, success or failure.",
+	}, []string{"result"})
+	certExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "airgap_webhook_tls_cert_expiry_timestamp_seconds",
+		Help: "Expiry of the serving tls certificate in seconds since the epoch.",
+	})
+	reportsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "airgap_webhook_reports_rejected_total",
+		Help: "Queued reports dropped because the backend rejected them with an error that retrying cannot fix.",
+	})
+)
+
+func init() {
+	metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		reviewsSkipped,
+		configReloads,
+		certReloads,
+		certExpiry,
+		reportsRejected,
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Mirror rewrites image references to pull from internal mirror
+// registries.
+type Mirror struct {
+	rules []ConfigMirrorRule
+}
+
+func NewMirror(config ConfigMirror) *Mirror {
+	return &Mirror{
+		rules: config.Rules,
+	}
+}
+
+// ParseMirrorRule parses a rule of the form from=to, for example
+// docker.io=mirror.internal/docker.io.
+func ParseMirrorRule(s string) (ConfigMirrorRule, error) {
+	from, to, found := strings.Cut(s, "=")
+	if !found || from == "" || to == "" {
+		return ConfigMirrorRule{}, fmt.Errorf("invalid mirror rule %q, expected from=to", s)
+	}
+	if _, err := path.Match(from, ""); err != nil {
+		return ConfigMirrorRule{}, fmt.Errorf("invalid mirror rule %q: %w", s, err)
+	}
+	return ConfigMirrorRule{
+		From: from,
+		To:   strings.TrimSuffix(to, "/"),
+	}, nil
+}
+
+// Rewrite returns the image on its mirror. The first rule whose from
+// matches the registry, exactly or as a wildcard, is applied by replacing
+// the registry with the rule's to prefix. Images already under the to
+// prefix of a rule are left alone, workloads are mutated again when their
+// controllers create ReplicaSets and Pods from them.
+func (m *Mirror) Rewrite(image Image) (Image, bool) {
+	if m == nil {
+		return image, false
+	}
+	for _, rule := range m.rules {
+		if isMirrored(image, rule.To) {
+			return image, false
+		}
+	}
+	for _, rule := range m.rules {
+		if matched, _ := path.Match(rule.From, image.registry); matched || rule.From == image.registry {
+			registry, prefix, _ := strings.Cut(rule.To, "/")
+			image.registry = registry
+			if prefix != "" {
+				image.repository = prefix + "/" + image.repository
+			}
+			return image, true
+		}
+	}
+	return image, false
+}
+
+// isMirrored reports whether the image is on the registry and under the
+// repository prefix of to.
+func isMirrored(image Image, to string) bool {
+	registry, prefix, _ := strings.Cut(to, "/")
+	if image.registry != registry {
+		return false
+	}
+	return prefix == "" || image.repository == prefix || strings.HasPrefix(image.repository, prefix+"/")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/imperialops/airgap-webhook/admission"
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func testMirror(t *testing.T, rules ...string) *Mirror {
+	config := ConfigMirror{}
+	for _, s := range rules {
+		rule, err := ParseMirrorRule(s)
+		assert.NoError(t, err)
+		config.Rules = append(config.Rules, rule)
+	}
+	return NewMirror(config)
+}
+
+func TestMirrorRewrite(t *testing.T) {
+	tests := []struct {
+		rule     string
+		image    string
+		expected string
+	}{
+		{"docker.io=mirror.internal/docker.io", "nginx:1.25", "mirror.internal/docker.io/library/nginx:1.25"},
+		{"*=mirror.internal/cache", "nginx:1.25", "mirror.internal/cache/library/nginx:1.25"},
+		{"*.io=mirror.io/x", "ghcr.io/a/b:1", "mirror.io/x/a/b:1"},
+		{"*=mirror.internal", "quay.io/a/b:1", "mirror.internal/a/b:1"},
+	}
+
+	for _, test := range tests {
+		mirror := testMirror(t, test.rule)
+		image, rewritten := mirror.Rewrite(MustImage(test.image))
+		assert.True(t, rewritten, test.rule)
+		assert.Equal(t, test.expected, image.String(), test.rule)
+
+		// Rewriting an image already on the mirror does nothing.
+		again, rewritten := mirror.Rewrite(image)
+		assert.False(t, rewritten, test.rule)
+		assert.Equal(t, image, again, test.rule)
+	}
+}
+
+func postMutate(t *testing.T, s *ApiServerCommon, resource []byte) *admissionv1.AdmissionResponse {
+	body, err := admission.CreateAdmissionReviewRequest(resource, "create", "imperialops", []string{})
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.newServeMux().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	return decodeResponse(t, w.Body.Bytes())
+}
+
+func TestParseMirrorRule(t *testing.T) {
+	rule, err := ParseMirrorRule("docker.io=mirror.internal/docker.io/")
+	assert.NoError(t, err)
+	assert.Equal(t, ConfigMirrorRule{From: "docker.io", To: "mirror.internal/docker.io"}, rule)
+
+	for _, s := range []string{"docker.io", "=mirror.internal", "docker.io=", "[=mirror.internal"} {
+		_, err := ParseMirrorRule(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestHandlePostMutate(t *testing.T) {
+	s := &ApiServerCommon{
+		config: &Config{},
+		mutator: &Mutator{
+			mirror: testMirror(t,
+				"docker.io=mirror.internal/docker.io",
+				"*.ecr.aws=mirror.internal/ecr",
+				"gcr.io=mirror.internal/gcr.io",
+			),
+		},
+	}
+
+	tests := []struct {
+		resource []byte
+		expected []PatchOperation
+	}{
+		{v1Pod, []PatchOperation{
+			{"replace", "/spec/initContainers/0/image", "mirror.internal/docker.io/library/busybox:1.28"},
+			{"replace", "/spec/containers/0/image", "mirror.internal/docker.io/library/nginx@sha256:f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1"},
+			{"replace", "/spec/containers/1/image", "mirror.internal/docker.io/library/nginx:stable@sha256:f3c37d8a26f7a7d8a547470c58733f270bcccb7e785da17af81ec41576170da8"},
+		}},
+		{v1Job, []PatchOperation{
+			{"replace", "/spec/template/spec/containers/0/image", "mirror.internal/docker.io/library/perl:5.34.0"},
+		}},
+		{v1CronJob, []PatchOperation{
+			{"replace", "/spec/jobTemplate/spec/template/spec/containers/0/image", "mirror.internal/docker.io/library/busybox:1.28"},
+		}},
+		{v1Deployment, []PatchOperation{
+			{"replace", "/spec/template/spec/containers/0/image", "mirror.internal/ecr/nginx/nginx:stable-perl@sha256:1b624e3e6af841b907b1f5747b6f29ccb5ccb422f9e881eae82bd4b8b72cb7a1"},
+		}},
+		{v1Daemonset, nil},
+		{v1StatefulSet, nil},
+		{v1ReplicaSet, []PatchOperation{
+			{"replace", "/spec/template/spec/containers/0/image", "mirror.internal/gcr.io/google_samples/gb-frontend:v3"},
+		}},
+	}
+
+	for _, test := range tests {
+		response := postMutate(t, s, test.resource)
+		assert.True(t, response.Allowed)
+		if test.expected == nil {
+			assert.Nil(t, response.Patch)
+			assert.Nil(t, response.PatchType)
+			continue
+		}
+
+		assert.Equal(t, admissionv1.PatchTypeJSONPatch, *response.PatchType)
+		patches := []PatchOperation{}
+		assert.NoError(t, json.Unmarshal(response.Patch, &patches))
+		assert.Equal(t, test.expected, patches)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+// Mutator computes the image rewrites applied by /mutate.
+type Mutator struct {
+	mirror  *Mirror
+	catalog IDigestCatalog
+	pin     bool
+}
+
+// PatchOperation is a single JSONPatch (RFC 6902) operation.
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value"`
+}
+
+func NewMutator(config *Config, catalog IDigestCatalog) *Mutator {
+	return &Mutator{
+		mirror:  NewMirror(config.Mirror),
+		catalog: catalog,
+		pin:     config.Digest.Pin,
+	}
+}
+
+// Mutate returns the image a container should run, which is pinned to its
+// catalog digest and then rewritten to its mirror.
+func (m *Mutator) Mutate(image Image) (Image, bool) {
+	mutated := false
+	if m.pin && m.catalog != nil && image.digest == "" {
+		if digest, ok := m.catalog.Digest(image); ok {
+			image = image.withDigest(digest)
+			mutated = true
+		}
+	}
+	if mirrored, ok := m.mirror.Rewrite(image); ok {
+		image = mirrored
+		mutated = true
+	}
+	return image, mutated
+}
+
+// Patch returns the operations replacing every container image that is
+// mutated.
+func (m *Mutator) Patch(containers []Container) []PatchOperation {
+	patches := []PatchOperation{}
+	if m == nil {
+		return patches
+	}
+	for _, container := range containers {
+		if container.err != nil || container.path == "" {
+			continue
+		}
+		if image, ok := m.Mutate(container.image); ok {
+			patches = append(patches, PatchOperation{
+				Op:    "replace",
+				Path:  container.path,
+				Value: image.String(),
+			})
+		}
+	}
+	return patches
+}
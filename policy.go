@@ -0,0 +1,396 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Policy modes control what happens to a violation: enforce denies the
+// request, warn allows it with a warning shown to the client and audit
+// allows it and only records the violation.
+const (
+	PolicyModeEnforce = "enforce"
+	PolicyModeWarn    = "warn"
+	PolicyModeAudit   = "audit"
+)
+
+// Unknown kind policies control requests for kinds the webhook cannot
+// extract images from.
+const (
+	UnknownKindAllow = "allow"
+	UnknownKindWarn  = "warn"
+	UnknownKindDeny  = "deny"
+)
+
+// Failure policies decide whether requests are allowed when the webhook
+// fails to process them, like the failurePolicy of a webhook
+// configuration.
+const (
+	FailurePolicyFail   = "fail"
+	FailurePolicyIgnore = "ignore"
+)
+
+// ExemptAnnotation exempts a workload from the policy, its value is the
+// justification. It is only honored for the configured users and groups.
+const ExemptAnnotation = "airgap.imperialops.io/exempt"
+
+// defaultExemptionControllers are the identities of the built-in
+// controllers creating pods and their owners, without and with service
+// account credentials.
+var defaultExemptionControllers = []string{
+	"system:kube-controller-manager",
+	"system:serviceaccount:kube-system:deployment-controller",
+	"system:serviceaccount:kube-system:replicaset-controller",
+	"system:serviceaccount:kube-system:replication-controller",
+	"system:serviceaccount:kube-system:statefulset-controller",
+	"system:serviceaccount:kube-system:daemon-set-controller",
+	"system:serviceaccount:kube-system:cronjob-controller",
+	"system:serviceaccount:kube-system:job-controller",
+}
+
+// Policy decides whether the images of an admission request are allowed.
+type Policy struct {
+	registries   ConfigRegistryPolicy
+	digests      ConfigDigestPolicy
+	unknownKinds string
+	failure      string
+	exemptions   ConfigExemptions
+	catalog      IDigestCatalog
+	inventory    IInventory
+	// owners is the inventory when reports are stored before the review
+	// is answered, owners are then always found when their pods arrive.
+	owners IInventory
+}
+
+// Exemption records who exempted a workload from the policy, when and why.
+type Exemption struct {
+	Reason string    `json:"reason"`
+	User   string    `json:"user"`
+	Time   time.Time `json:"time"`
+}
+
+// Violation is a container that does not comply with the policy.
+type Violation struct {
+	container Container
+	message   string
+	mode      string
+}
+
+func NewPolicy(config ConfigPolicy, catalog IDigestCatalog, inventory, owners IInventory) *Policy {
+	return &Policy{
+		registries:   config.Registries,
+		digests:      config.Digests,
+		unknownKinds: config.UnknownKinds,
+		failure:      config.Failure,
+		exemptions:   config.Exemptions,
+		catalog:      catalog,
+		inventory:    inventory,
+		owners:       owners,
+	}
+}
+
+func isUnknownKindPolicy(policy string) bool {
+	switch policy {
+	case UnknownKindAllow, UnknownKindWarn, UnknownKindDeny:
+		return true
+	default:
+		return false
+	}
+}
+
+func isFailurePolicy(policy string) bool {
+	return policy == FailurePolicyFail || policy == FailurePolicyIgnore
+}
+
+func isPolicyMode(mode string) bool {
+	switch mode {
+	case PolicyModeEnforce, PolicyModeWarn, PolicyModeAudit:
+		return true
+	default:
+		return false
+	}
+}
+
+// Evaluate returns a violation for every container breaking the policy.
+func (p *Policy) Evaluate(containers []Container) []Violation {
+	violations := []Violation{}
+	if p == nil {
+		p = &Policy{}
+	}
+
+	for _, container := range containers {
+		if container.err != nil {
+			violations = append(violations, Violation{
+				container: container,
+				message:   container.err.Error(),
+				mode:      PolicyModeEnforce,
+			})
+			continue
+		}
+		if !p.isRegistryAllowed(container.image.registry) {
+			violations = append(violations, Violation{
+				container: container,
+				message:   fmt.Sprintf("registry %s is not allowed", container.image.registry),
+				mode:      p.registries.Mode,
+			})
+		}
+		if p.digests.Required && !p.hasDigest(container.image) {
+			violations = append(violations, Violation{
+				container: container,
+				message:   "image is not pinned to a digest and no digest is known for its tag",
+				mode:      p.digests.Mode,
+			})
+		}
+	}
+	return violations
+}
+
+// Exemption returns the exemption requested by the annotation of the
+// object, requested is set even when the requesting user is not allowed
+// to exempt workloads and nil is returned. Objects created by controllers
+// inherit the exemption of their owner instead.
+func (p *Policy) Exemption(r *AdmissionReview) (exemption *Exemption, requested bool) {
+	if len(r.Request.Object.Raw) == 0 {
+		return nil, false
+	}
+	object, err := objectMeta(r.Request.Object.Raw)
+	if err != nil {
+		return nil, false
+	}
+	reason := object.Annotations[ExemptAnnotation]
+	user := r.Request.UserInfo.Username
+	if reason != "" && p != nil && p.canExempt(user, r.Request.UserInfo.Groups) {
+		log.Printf("exempting %s %s/%s by %s: %s", r.Request.Kind.Kind, r.Request.Namespace, r.Request.Name, user, reason)
+		// An update keeps the time and user of the first grant.
+		if previous := recordedExemption(p.inventory, Workload{Namespace: r.Request.Namespace, Kind: r.Request.Kind.Kind, Name: r.Request.Name}); previous != nil && previous.Reason == reason {
+			return previous, true
+		}
+		return &Exemption{
+			Reason: reason,
+			User:   user,
+			Time:   time.Now().UTC(),
+		}, true
+	}
+
+	// Controllers copy the annotation of a Deployment to its ReplicaSets
+	// but not to the Pods they create, nor the one of a CronJob to its
+	// Jobs.
+	if exemption := p.inheritedExemption(r, object); exemption != nil {
+		return exemption, false
+	}
+	if reason != "" {
+		log.Printf("ignoring exemption of %s %s/%s by %s, not allowed to exempt workloads", r.Request.Kind.Kind, r.Request.Namespace, r.Request.Name, user)
+		return nil, true
+	}
+	return nil, false
+}
+
+// inheritedExemption returns the exemption recorded in the inventory for
+// the controller owning the object, when the object is created or updated
+// by one of the exemption controllers. Owners are only looked up in an
+// inventory written synchronously, a queued report of the owner may not
+// be stored yet.
+func (p *Policy) inheritedExemption(r *AdmissionReview, object *metav1.PartialObjectMetadata) *Exemption {
+	if p == nil || !p.isController(r.Request.UserInfo.Username, r.Request.UserInfo.Groups) {
+		return nil
+	}
+	owner := metav1.GetControllerOfNoCopy(object)
+	if owner == nil {
+		return nil
+	}
+	if p.owners == nil {
+		log.Printf("not inheriting the exemption of %s %s/%s for %s %s, requires the embedded backend in sync mode", owner.Kind, r.Request.Namespace, owner.Name, r.Request.Kind.Kind, object.Name)
+		return nil
+	}
+	exemption := recordedExemption(p.owners, Workload{Namespace: r.Request.Namespace, Kind: owner.Kind, Name: owner.Name})
+	if exemption != nil {
+		log.Printf("exempting %s %s/%s owned by %s %s: %s", r.Request.Kind.Kind, r.Request.Namespace, object.Name, owner.Kind, owner.Name, exemption.Reason)
+	}
+	return exemption
+}
+
+// recordedExemption returns the exemption of the workload in the
+// inventory, if any.
+func recordedExemption(inventory IInventory, workload Workload) *Exemption {
+	if inventory == nil || workload.Name == "" {
+		return nil
+	}
+	record, err := inventory.Workload(workload)
+	if err != nil {
+		log.Printf("unable to look up the exemption of %s %s/%s: %s", workload.Kind, workload.Namespace, workload.Name, err)
+		return nil
+	}
+	if record == nil {
+		return nil
+	}
+	return record.Exemption
+}
+
+func (p *Policy) canExempt(user string, groups []string) bool {
+	for _, u := range p.exemptions.Users {
+		if u == user {
+			return true
+		}
+	}
+	for _, g := range p.exemptions.Groups {
+		for _, group := range groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isController reports whether the user or one of its groups is listed in
+// the exemption controllers.
+func (p *Policy) isController(user string, groups []string) bool {
+	for _, controller := range p.exemptions.Controllers {
+		if controller == user || containsString(groups, controller) {
+			return true
+		}
+	}
+	return false
+}
+
+// exempt turns the violations of valid images into audit ones, they are
+// still logged and recorded but allowed through.
+func exempt(violations []Violation) []Violation {
+	for i := range violations {
+		if violations[i].container.err == nil {
+			violations[i].mode = PolicyModeAudit
+		}
+	}
+	return violations
+}
+
+// UnknownKindResponse returns the response to a request for a kind the
+// webhook cannot extract images from.
+func (p *Policy) UnknownKindResponse(kind string) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{}
+	response.Allowed = true
+
+	message := fmt.Sprintf("resource kind %s is not supported by the airgap webhook, its images are not checked", kind)
+	unknownKinds := UnknownKindAllow
+	if p != nil {
+		unknownKinds = p.unknownKinds
+	}
+	switch unknownKinds {
+	case UnknownKindWarn:
+		response.Warnings = []string{message}
+	case UnknownKindDeny:
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusForbidden,
+			Reason:  metav1.StatusReasonForbidden,
+			Message: fmt.Sprintf("resource kind %s is not supported by the airgap webhook", kind),
+		}
+	}
+	log.Printf("%s unknown kind %s", unknownKinds, kind)
+	return response
+}
+
+// FailureResponse returns the response to a request the webhook failed to
+// process. The request is allowed only with the ignore failure policy,
+// the status carries the error either way.
+func (p *Policy) FailureResponse(err error) *admissionv1.AdmissionResponse {
+	code := http.StatusInternalServerError
+	var apiError *ApiError
+	if errors.As(err, &apiError) {
+		code = apiError.Code()
+	}
+
+	response := &admissionv1.AdmissionResponse{}
+	response.Allowed = p != nil && p.failure == FailurePolicyIgnore
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    int32(code),
+		Reason:  statusReason(code),
+		Message: err.Error(),
+	}
+	return response
+}
+
+// statusReason maps an http status code to the reason of a Status.
+func statusReason(code int) metav1.StatusReason {
+	switch code {
+	case http.StatusBadRequest:
+		return metav1.StatusReasonBadRequest
+	case http.StatusForbidden:
+		return metav1.StatusReasonForbidden
+	case http.StatusMethodNotAllowed:
+		return metav1.StatusReasonMethodNotAllowed
+	case http.StatusUnsupportedMediaType:
+		return metav1.StatusReasonUnsupportedMediaType
+	case http.StatusServiceUnavailable:
+		return metav1.StatusReasonServiceUnavailable
+	default:
+		return metav1.StatusReasonInternalError
+	}
+}
+
+// isRegistryAllowed matches the registry against the allowlist, which
+// holds exact hosts or wildcard patterns such as *.example.com. An empty
+// allowlist allows every registry.
+func (p *Policy) isRegistryAllowed(registry string) bool {
+	if len(p.registries.Allowed) == 0 {
+		return true
+	}
+	for _, pattern := range p.registries.Allowed {
+		if pattern == registry {
+			return true
+		}
+		if matched, _ := path.Match(pattern, registry); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDigest reports whether the image is pinned to a digest or can be
+// pinned using the digest catalog.
+func (p *Policy) hasDigest(image Image) bool {
+	if image.digest != "" {
+		return true
+	}
+	if p.catalog == nil {
+		return false
+	}
+	_, ok := p.catalog.Digest(image)
+	return ok
+}
+
+func (v Violation) String() string {
+	if v.container.err != nil {
+		return fmt.Sprintf("container %s image %q: %s", v.container.name, v.container.ref, v.message)
+	}
+	return fmt.Sprintf("container %s image %s: %s", v.container.name, v.container.image, v.message)
+}
+
+// filterViolations returns the violations evaluated in the given mode.
+func filterViolations(violations []Violation, mode string) []Violation {
+	filtered := []Violation{}
+	for _, violation := range violations {
+		if violation.mode == mode {
+			filtered = append(filtered, violation)
+		}
+	}
+	return filtered
+}
+
+func violationsMessage(violations []Violation) string {
+	messages := make([]string, len(violations))
+	for i, violation := range violations {
+		messages[i] = violation.String()
+	}
+	return "images violate the airgap policy: " + strings.Join(messages, "; ")
+}
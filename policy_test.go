@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestIsRegistryAllowed(t *testing.T) {
+	policy := NewPolicy(ConfigPolicy{
+		Registries: ConfigRegistryPolicy{
+			Mode:    PolicyModeEnforce,
+			Allowed: []string{"mirror.internal", "*.ecr.aws", "registry-*.corp:5000"},
+		},
+	}, nil, nil, nil)
+
+	tests := []struct {
+		registry string
+		expected bool
+	}{
+		{"mirror.internal", true},
+		{"docker.io", false},
+		{"public.ecr.aws", true},
+		{"ecr.aws", false},
+		{"registry-eu.corp:5000", true},
+		{"registry-eu.corp", false},
+		{"mirror.internal.evil.com", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, policy.isRegistryAllowed(test.registry), test.registry)
+	}
+
+	assert.True(t, NewPolicy(ConfigPolicy{}, nil, nil, nil).isRegistryAllowed("docker.io"))
+}
+
+func decodeResponse(t *testing.T, body []byte) *admissionv1.AdmissionResponse {
+	review := admissionv1.AdmissionReview{}
+	assert.NoError(t, json.Unmarshal(body, &review))
+	return review.Response
+}
+
+func TestHandlePostValidatePolicy(t *testing.T) {
+	backend := &fakeBackend{}
+	s := &ApiServerCommon{
+		config:  &Config{},
+		backend: backend,
+		policy: NewPolicy(ConfigPolicy{
+			Registries: ConfigRegistryPolicy{
+				Mode:    PolicyModeEnforce,
+				Allowed: []string{"ghcr.io"},
+			},
+		}, nil, nil, nil),
+	}
+
+	w := postValidate(t, s, v1Pod)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	response := decodeResponse(t, w.Body.Bytes())
+	assert.False(t, response.Allowed)
+	assert.Equal(t, int32(http.StatusForbidden), response.Result.Code)
+	assert.Equal(t, "images violate the airgap policy: "+
+		"container init image docker.io/library/busybox:1.28: registry docker.io is not allowed; "+
+		"container weblatest image docker.io/library/nginx@sha256:f2fee5c7194cbbfb9d2711fa5de094c797a42a51aa42b0c8ee8ca31547c872b1: registry docker.io is not allowed; "+
+		"container webstable image docker.io/library/nginx:stable@sha256:f3c37d8a26f7a7d8a547470c58733f270bcccb7e785da17af81ec41576170da8: registry docker.io is not allowed",
+		response.Result.Message)
+	assert.Empty(t, backend.Reports(), "denied requests must not be reported")
+
+	w = postValidate(t, s, v1Job)
+	assert.False(t, decodeResponse(t, w.Body.Bytes()).Allowed)
+
+	s.policy = NewPolicy(ConfigPolicy{
+		Registries: ConfigRegistryPolicy{
+			Mode:    PolicyModeEnforce,
+			Allowed: []string{"*.io"},
+		},
+	}, nil, nil, nil)
+	w = postValidate(t, s, v1Pod)
+	assert.True(t, decodeResponse(t, w.Body.Bytes()).Allowed)
+	assert.Len(t, backend.Reports(), 1)
+}
+
+func TestHandlePostValidatePolicyModes(t *testing.T) {
+	tests := []struct {
+		mode     string
+		warnings []string
+	}{
+		{PolicyModeWarn, []string{"container pi image docker.io/library/perl:5.34.0: registry docker.io is not allowed"}},
+		{PolicyModeAudit, nil},
+	}
+
+	for _, test := range tests {
+		backend := &fakeBackend{}
+		s := &ApiServerCommon{
+			config:  &Config{},
+			backend: backend,
+			policy: NewPolicy(ConfigPolicy{
+				Registries: ConfigRegistryPolicy{
+					Mode:    test.mode,
+					Allowed: []string{"mirror.internal"},
+				},
+			}, nil, nil, nil),
+		}
+
+		w := postValidate(t, s, v1Job)
+		response := decodeResponse(t, w.Body.Bytes())
+		assert.True(t, response.Allowed, test.mode)
+		assert.Nil(t, response.Result, test.mode)
+		assert.Equal(t, test.warnings, response.Warnings, test.mode)
+
+		reports := backend.Reports()
+		assert.Len(t, reports, 1, test.mode)
+		assert.Equal(t, []string{"container pi image docker.io/library/perl:5.34.0: registry docker.io is not allowed"}, reports[0].Violations, test.mode)
+	}
+}
+
+func TestHandlePostValidateInvalidImage(t *testing.T) {
+	pod := []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: broken
+spec:
+  containers:
+  - name: app
+    image: app@sha256
+  - name: sidecar
+    image: busybox:1.28`)
+
+	backend := &fakeBackend{}
+	s := &ApiServerCommon{config: &Config{}, backend: backend}
+
+	response := decodeResponse(t, postValidate(t, s, pod).Body.Bytes())
+	assert.False(t, response.Allowed)
+	assert.Equal(t, `images violate the airgap policy: container app image "app@sha256": invalid image reference "app@sha256": invalid digest "sha256"`, response.Result.Message)
+	assert.Empty(t, backend.Reports())
+}
+
+func TestHandlePostValidateEphemeralContainers(t *testing.T) {
+	s := &ApiServerCommon{
+		config: &Config{},
+		policy: NewPolicy(ConfigPolicy{
+			Registries: ConfigRegistryPolicy{
+				Mode:    PolicyModeEnforce,
+				Allowed: []string{"mirror.internal"},
+			},
+		}, nil, nil, nil),
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(newReview(t, v1PodDebug, withOperation("update"), withSubResource("ephemeralcontainers"), withOldObject(nil))))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.newServeMux().ServeHTTP(w, r)
+
+	response := decodeResponse(t, w.Body.Bytes())
+	assert.False(t, response.Allowed)
+	assert.Contains(t, response.Result.Message, "container debugger image docker.io/library/busybox:1.28: registry docker.io is not allowed")
+}
+
+func TestHandlePostValidateUnknownKind(t *testing.T) {
+	tests := []struct {
+		policy   string
+		allowed  bool
+		warnings int
+	}{
+		{UnknownKindAllow, true, 0},
+		{UnknownKindWarn, true, 1},
+		{UnknownKindDeny, false, 0},
+	}
+
+	for _, test := range tests {
+		backend := &fakeBackend{}
+		s := &ApiServerCommon{
+			config:  &Config{},
+			backend: backend,
+			policy:  NewPolicy(ConfigPolicy{UnknownKinds: test.policy}, nil, nil, nil),
+		}
+
+		w := postValidate(t, s, v1alpha1Rollout)
+		assert.Equal(t, http.StatusOK, w.Code, test.policy)
+
+		review := admissionv1.AdmissionReview{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &review), test.policy)
+		assert.Equal(t, "AdmissionReview", review.Kind, test.policy)
+		assert.NotEmpty(t, review.Response.UID, test.policy)
+		assert.Equal(t, test.allowed, review.Response.Allowed, test.policy)
+		assert.Len(t, review.Response.Warnings, test.warnings, test.policy)
+		if !test.allowed {
+			assert.Equal(t, int32(http.StatusForbidden), review.Response.Result.Code, test.policy)
+			assert.Contains(t, review.Response.Result.Message, "argoproj.io/v1alpha1/Rollout", test.policy)
+		}
+		assert.Empty(t, backend.Reports(), test.policy)
+	}
+
+	response := postMutate(t, &ApiServerCommon{config: &Config{}}, v1alpha1Rollout)
+	assert.True(t, response.Allowed)
+	assert.Empty(t, response.Patch)
+}
+
+func TestHandlePostValidateExemption(t *testing.T) {
+	exempted := []byte(`apiVersion: batch/v1
+kind: Job
+metadata:
+  name: restore
+  annotations:
+    airgap.imperialops.io/exempt: "INC-1234 restore from vendor registry"
+spec:
+  template:
+    spec:
+      containers:
+      - name: restore
+        image: vendor.example.com/restore:2.1
+      restartPolicy: Never`)
+
+	tests := []struct {
+		exemptions ConfigExemptions
+		allowed    bool
+	}{
+		{ConfigExemptions{}, false},
+		{ConfigExemptions{Users: []string{"imperialops"}}, true},
+		{ConfigExemptions{Users: []string{"admin"}, Groups: []string{"system:masters"}}, false},
+	}
+
+	for _, test := range tests {
+		backend := &fakeBackend{}
+		s := &ApiServerCommon{
+			config:  &Config{},
+			backend: backend,
+			policy: NewPolicy(ConfigPolicy{
+				Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce, Allowed: []string{"mirror.internal"}},
+				Exemptions: test.exemptions,
+			}, nil, nil, nil),
+		}
+
+		response := decodeResponse(t, postValidate(t, s, exempted).Body.Bytes())
+		assert.Equal(t, test.allowed, response.Allowed, test.exemptions)
+		if !test.allowed {
+			assert.Equal(t, []string{"annotation airgap.imperialops.io/exempt ignored, imperialops is not allowed to exempt workloads"}, response.Warnings)
+			assert.Empty(t, backend.Reports())
+			continue
+		}
+
+		reports := backend.Reports()
+		assert.Len(t, reports, 1)
+		assert.Equal(t, "INC-1234 restore from vendor registry", reports[0].Exemption.Reason)
+		assert.Equal(t, "imperialops", reports[0].Exemption.User)
+		assert.False(t, reports[0].Exemption.Time.IsZero())
+		assert.Equal(t, []string{"container restore image vendor.example.com/restore:2.1: registry vendor.example.com is not allowed"}, reports[0].Violations)
+	}
+
+	// Exemptions require the annotation, not only an allowed user.
+	s := &ApiServerCommon{
+		config: &Config{},
+		policy: NewPolicy(ConfigPolicy{
+			Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce, Allowed: []string{"mirror.internal"}},
+			Exemptions: ConfigExemptions{Users: []string{"imperialops"}},
+		}, nil, nil, nil),
+	}
+	assert.False(t, decodeResponse(t, postValidate(t, s, v1Job).Body.Bytes()).Allowed)
+}
+
+func TestHandlePostValidateInheritedExemption(t *testing.T) {
+	cronJob := []byte(`apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: restore
+  namespace: default
+  annotations:
+    airgap.imperialops.io/exempt: "INC-1234 restore from vendor registry"
+spec:
+  schedule: "0 * * * *"
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: restore
+            image: vendor.example.com/restore:2.1
+          restartPolicy: Never`)
+	job := []byte(`apiVersion: batch/v1
+kind: Job
+metadata:
+  name: restore-28000000
+  namespace: default
+  ownerReferences:
+  - apiVersion: batch/v1
+    kind: CronJob
+    name: restore
+    uid: 5b1c6f0e-0000-4000-8000-000000000001
+    controller: true
+spec:
+  template:
+    spec:
+      containers:
+      - name: restore
+        image: vendor.example.com/restore:2.1
+      restartPolicy: Never`)
+	pod := []byte(`apiVersion: v1
+kind: Pod
+metadata:
+  name: restore-28000000-x7k2p
+  namespace: default
+  ownerReferences:
+  - apiVersion: batch/v1
+    kind: Job
+    name: restore-28000000
+    uid: 5b1c6f0e-0000-4000-8000-000000000002
+    controller: true
+spec:
+  containers:
+  - name: restore
+    image: vendor.example.com/restore:2.1
+  restartPolicy: Never`)
+
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "inventory.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+	s := &ApiServerCommon{
+		config:  &Config{},
+		backend: store,
+		policy: NewPolicy(ConfigPolicy{
+			Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce, Allowed: []string{"mirror.internal"}},
+			Exemptions: ConfigExemptions{Users: []string{"oncall"}, Controllers: defaultExemptionControllers},
+		}, nil, store, store),
+	}
+	controller := []string{"system:serviceaccounts", "system:serviceaccounts:kube-system"}
+
+	// The CronJob is exempted, its Job and the Job's Pod are created by
+	// controllers and inherit the exemption.
+	response := decodeResponse(t, postValidateReview(t, s, newReview(t, cronJob, withUser("oncall"))).Body.Bytes())
+	assert.True(t, response.Allowed)
+	granted, err := store.Workload(Workload{Namespace: "default", Kind: "CronJob", Name: "restore"})
+	assert.NoError(t, err)
+
+	response = decodeResponse(t, postValidateReview(t, s, newReview(t, job, withUser("system:serviceaccount:kube-system:cronjob-controller", controller...))).Body.Bytes())
+	assert.True(t, response.Allowed)
+	response = decodeResponse(t, postValidateReview(t, s, newReview(t, pod, withUser("system:serviceaccount:kube-system:job-controller", controller...))).Body.Bytes())
+	assert.True(t, response.Allowed)
+	record, err := store.Workload(Workload{Namespace: "default", Kind: "Pod", Name: "restore-28000000-x7k2p"})
+	assert.NoError(t, err)
+	assert.Equal(t, granted.Exemption, record.Exemption)
+
+	// Only controllers can claim the exemption of an owner, not any
+	// service account of kube-system.
+	response = decodeResponse(t, postValidateReview(t, s, newReview(t, pod, withUser("developer"))).Body.Bytes())
+	assert.False(t, response.Allowed)
+	response = decodeResponse(t, postValidateReview(t, s, newReview(t, pod, withUser("system:serviceaccount:kube-system:default", controller...))).Body.Bytes())
+	assert.False(t, response.Allowed)
+
+	// Owners are not looked up when their reports are queued.
+	s.policy.owners = nil
+	response = decodeResponse(t, postValidateReview(t, s, newReview(t, pod, withUser("system:serviceaccount:kube-system:job-controller", controller...))).Body.Bytes())
+	assert.False(t, response.Allowed)
+
+	// Updating the exempted CronJob keeps the time of the first grant.
+	updated := bytes.Replace(cronJob, []byte("restore:2.1"), []byte("restore:2.2"), 1)
+	response = decodeResponse(t, postValidateReview(t, s, newReview(t, updated, withOperation("update"), withOldObject(cronJob), withUser("oncall"))).Body.Bytes())
+	assert.True(t, response.Allowed)
+	record, err = store.Workload(Workload{Namespace: "default", Kind: "CronJob", Name: "restore"})
+	assert.NoError(t, err)
+	assert.Equal(t, []Image{MustImage("vendor.example.com/restore:2.2")}, record.Images)
+	assert.True(t, granted.Exemption.Time.Equal(record.Exemption.Time))
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Queue delivers reports to a backend from a pool of workers. Reports are
+// grouped into batches and retried with exponential backoff until the
+// backend accepts them. When a write-ahead log is configured every report
+// is persisted before it is queued, so pending reports survive restarts.
+// Delivery is at least once.
+type Queue struct {
+	backend IBackend
+	config  ConfigQueue
+	wal     *Wal
+	items   chan queueItem
+	notify  chan struct{}
+	// draining is closed on shutdown, the workers then deliver what is
+	// left in memory and exit. done is closed to stop them right away.
+	draining  chan struct{}
+	done      chan struct{}
+	drainOnce sync.Once
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+}
+
+type queueItem struct {
+	seq    uint64
+	report Report
+}
+
+func NewQueue(backend IBackend, config ConfigQueue) (*Queue, error) {
+	q := &Queue{
+		backend:  backend,
+		config:   config,
+		items:    make(chan queueItem, config.Capacity),
+		notify:   make(chan struct{}, 1),
+		draining: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	if config.WalDir != "" {
+		wal, err := OpenWal(config.WalDir, config.WalMaxSize)
+		if err != nil {
+			return nil, err
+		}
+		q.wal = wal
+		q.wg.Add(1)
+		go q.feed()
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q, nil
+}
+
+// Send queues the reports for delivery. Reports are dropped rather than
+// blocking the caller when the queue is full.
+func (q *Queue) Send(reports []Report) error {
+	for _, report := range reports {
+		if q.wal == nil {
+			select {
+			case q.items <- queueItem{report: report}:
+			default:
+				log.Printf("backend queue is full, dropping report for %s/%s", report.Namespace, report.Name)
+			}
+			continue
+		}
+
+		if _, err := q.wal.Append(report); err != nil {
+			log.Printf("unable to persist report for %s/%s, dropping: %s", report.Namespace, report.Name, err)
+			continue
+		}
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (q *Queue) Healthy() error {
+	if h, ok := q.backend.(IHealthCheck); ok {
+		return h.Healthy()
+	}
+	return nil
+}
+
+// Unwrap returns the backend reports are delivered to.
+func (q *Queue) Unwrap() IBackend {
+	return q.backend
+}
+
+// Close stops the workers. Reports still in the write-ahead log are
+// delivered the next time it is opened.
+func (q *Queue) Close() error {
+	q.drainOnce.Do(func() { close(q.draining) })
+	q.stop()
+	return q.closeWal()
+}
+
+// Shutdown delivers the reports queued in memory and stops the workers.
+// When ctx ends first the remaining reports are dropped, or delivered the
+// next time the write-ahead log is opened.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.drainOnce.Do(func() { close(q.draining) })
+	drained := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return q.closeWal()
+	case <-ctx.Done():
+		left := len(q.items)
+		q.stop()
+		return errors.Join(fmt.Errorf("backend queue not drained in time, %d reports left: %w", left, ctx.Err()), q.closeWal())
+	}
+}
+
+func (q *Queue) stop() {
+	q.stopOnce.Do(func() { close(q.done) })
+	q.wg.Wait()
+}
+
+func (q *Queue) closeWal() error {
+	if q.wal != nil {
+		return q.wal.Close()
+	}
+	return nil
+}
+
+// feed moves reports from the write-ahead log into the in-memory queue as
+// the workers make room for them.
+func (q *Queue) feed() {
+	defer q.wg.Done()
+	for {
+		items, err := q.wal.Next(q.config.Capacity)
+		if err != nil {
+			log.Printf("unable to read write-ahead log: %s", err)
+		}
+		if len(items) == 0 {
+			select {
+			case <-q.notify:
+				continue
+			case <-q.draining:
+				return
+			}
+		}
+		for _, item := range items {
+			select {
+			case q.items <- item:
+			case <-q.draining:
+				return
+			}
+		}
+	}
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		var batch []queueItem
+		select {
+		case item := <-q.items:
+			batch = append(batch, item)
+		case <-q.draining:
+			select {
+			case item := <-q.items:
+				batch = append(batch, item)
+			default:
+				return
+			}
+		case <-q.done:
+			return
+		}
+
+		timer := time.NewTimer(q.config.BatchWindow)
+	collect:
+		for len(batch) < q.config.BatchSize {
+			select {
+			case item := <-q.items:
+				batch = append(batch, item)
+			case <-timer.C:
+				break collect
+			case <-q.draining:
+				select {
+				case item := <-q.items:
+					batch = append(batch, item)
+				default:
+					break collect
+				}
+			case <-q.done:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		q.deliver(batch)
+	}
+}
+
+func (q *Queue) deliver(batch []queueItem) {
+	reports := make([]Report, len(batch))
+	seqs := make([]uint64, len(batch))
+	for i, item := range batch {
+		reports[i] = item.report
+		seqs[i] = item.seq
+	}
+
+	wait := q.config.Backoff
+	for {
+		err := q.backend.Send(reports)
+		if err == nil {
+			break
+		}
+		// A rejected batch would block the worker forever, it is dropped
+		// and acknowledged like a delivered one.
+		if !isRetryable(err) {
+			log.Printf("backend rejected %d reports, dropping them: %s", len(reports), err)
+			reportsRejected.Add(float64(len(reports)))
+			break
+		}
+		log.Printf("unable to deliver %d reports to backend, retrying in %s: %s", len(reports), wait, err)
+		select {
+		case <-time.After(wait):
+		case <-q.done:
+			return
+		}
+		wait *= 2
+		if wait > q.config.MaxBackoff {
+			wait = q.config.MaxBackoff
+		}
+	}
+
+	if q.wal != nil {
+		if err := q.wal.Ack(seqs...); err != nil {
+			log.Printf("unable to acknowledge delivered reports: %s", err)
+		}
+	}
+}
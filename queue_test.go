@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type flakyBackend struct {
+	fakeBackend
+	failures int
+	batches  []int
+}
+
+func (b *flakyBackend) Send(reports []Report) error {
+	b.mu.Lock()
+	if b.failures > 0 {
+		b.failures--
+		b.mu.Unlock()
+		return errors.New("unavailable")
+	}
+	b.batches = append(b.batches, len(reports))
+	b.mu.Unlock()
+	return b.fakeBackend.Send(reports)
+}
+
+func testQueueConfig(walDir string) ConfigQueue {
+	return ConfigQueue{
+		Capacity:    10,
+		Workers:     1,
+		BatchSize:   5,
+		BatchWindow: 20 * time.Millisecond,
+		Backoff:     time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+		WalDir:      walDir,
+	}
+}
+
+func testQueueReports(n int) []Report {
+	reports := []Report{}
+	for i := 0; i < n; i++ {
+		reports = append(reports, Report{
+			Namespace: "default",
+			Kind:      "Pod",
+			Name:      fmt.Sprintf("pod-%d", i),
+			Operation: "CREATE",
+			Images:    []Image{MustImage("busybox:1.28")},
+		})
+	}
+	return reports
+}
+
+func TestQueueBatches(t *testing.T) {
+	backend := &flakyBackend{}
+	queue, err := NewQueue(backend, testQueueConfig(""))
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	assert.NoError(t, queue.Send(testQueueReports(7)))
+	assert.Eventually(t, func() bool {
+		return len(backend.Reports()) == 7
+	}, time.Second, 10*time.Millisecond)
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	assert.Equal(t, []int{5, 2}, backend.batches)
+}
+
+func TestQueueRetries(t *testing.T) {
+	backend := &flakyBackend{failures: 3}
+	queue, err := NewQueue(backend, testQueueConfig(t.TempDir()))
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	assert.NoError(t, queue.Send(testQueueReports(3)))
+	assert.Eventually(t, func() bool {
+		return len(backend.Reports()) == 3
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return queue.wal.Pending() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueueRejected(t *testing.T) {
+	backend := &rejectingBackend{}
+	queue, err := NewQueue(backend, testQueueConfig(t.TempDir()))
+	assert.NoError(t, err)
+	defer queue.Close()
+
+	// A rejected batch is dropped instead of retried, later reports are
+	// still delivered.
+	rejected := testutil.ToFloat64(reportsRejected)
+	assert.NoError(t, queue.Send(testQueueReports(3)))
+	assert.Eventually(t, func() bool {
+		return queue.wal.Pending() == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, rejected+3, testutil.ToFloat64(reportsRejected))
+
+	backend.mu.Lock()
+	backend.accept = true
+	backend.mu.Unlock()
+	assert.NoError(t, queue.Send(testQueueReports(2)))
+	assert.Eventually(t, func() bool {
+		return len(backend.Reports()) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQueueOverflow(t *testing.T) {
+	backend := &blockingBackend{release: make(chan struct{})}
+	config := testQueueConfig("")
+	config.Capacity = 2
+	config.BatchSize = 1
+	queue, err := NewQueue(backend, config)
+	assert.NoError(t, err)
+
+	// One report is held by the blocked worker, two fit in the queue and
+	// the remaining ones are dropped.
+	assert.NoError(t, queue.Send(testQueueReports(1)))
+	assert.Eventually(t, func() bool {
+		return len(queue.items) == 0
+	}, time.Second, time.Millisecond)
+	assert.NoError(t, queue.Send(testQueueReports(5)))
+	assert.Equal(t, 2, len(queue.items))
+
+	close(backend.release)
+	queue.Close()
+}
+
+func TestQueueShutdown(t *testing.T) {
+	backend := &flakyBackend{}
+	config := testQueueConfig("")
+	config.BatchWindow = time.Minute
+	queue, err := NewQueue(backend, config)
+	assert.NoError(t, err)
+
+	// The batch window is not waited for, queued reports are delivered
+	// right away.
+	assert.NoError(t, queue.Send(testQueueReports(7)))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, queue.Shutdown(ctx))
+	assert.Equal(t, testQueueReports(7), backend.Reports())
+}
+
+func TestQueueShutdownTimeout(t *testing.T) {
+	backend := &flakyBackend{failures: 1 << 30}
+	queue, err := NewQueue(backend, testQueueConfig(""))
+	assert.NoError(t, err)
+
+	assert.NoError(t, queue.Send(testQueueReports(7)))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, queue.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Empty(t, backend.Reports())
+}
+
+func TestQueueWalReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	backend := &flakyBackend{failures: 1 << 30}
+	queue, err := NewQueue(backend, testQueueConfig(dir))
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Send(testQueueReports(4)))
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, queue.Close())
+	assert.Empty(t, backend.Reports())
+
+	backend = &flakyBackend{}
+	queue, err = NewQueue(backend, testQueueConfig(dir))
+	assert.NoError(t, err)
+	defer queue.Close()
+	assert.Eventually(t, func() bool {
+		return len(backend.Reports()) == 4
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, testQueueReports(4), backend.Reports())
+}
+
+func TestWalCompaction(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWal(dir, 0)
+	assert.NoError(t, err)
+
+	reports := testQueueReports(3)
+	for _, report := range reports {
+		_, err := wal.Append(report)
+		assert.NoError(t, err)
+	}
+	items, err := wal.Next(10)
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+	assert.NoError(t, wal.Ack(items[0].seq, items[2].seq))
+	assert.NoError(t, wal.Close())
+
+	wal, err = OpenWal(dir, 0)
+	assert.NoError(t, err)
+	items, err = wal.Next(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []queueItem{{seq: 2, report: reports[1]}}, items)
+
+	assert.NoError(t, wal.Ack(items[0].seq))
+	assert.Equal(t, int64(0), wal.size)
+	assert.NoError(t, wal.Close())
+}
+
+func TestWalMaxSize(t *testing.T) {
+	wal, err := OpenWal(t.TempDir(), 100)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	_, err = wal.Append(testQueueReports(1)[0])
+	assert.ErrorIs(t, err, ErrWalFull)
+}
+
+func TestWalCompactsWhileRunning(t *testing.T) {
+	dir := t.TempDir()
+	reports := testQueueReports(50)
+	wal, err := OpenWal(dir, 0)
+	assert.NoError(t, err)
+	_, err = wal.Append(reports[0])
+	assert.NoError(t, err)
+	record := wal.size
+
+	// The first report stays pending while the others are delivered, the
+	// log never empties but only pending reports count against the limit.
+	wal.maxSize = 3 * record
+	wal.compactSize = 4 * record
+	held, err := wal.Next(1)
+	assert.NoError(t, err)
+	for _, report := range reports[1:] {
+		_, err := wal.Append(report)
+		assert.NoError(t, err)
+		items, err := wal.Next(10)
+		assert.NoError(t, err)
+		assert.Len(t, items, 1)
+		assert.NoError(t, wal.Ack(items[0].seq))
+		assert.LessOrEqual(t, wal.size, 2*wal.compactSize)
+	}
+	assert.Equal(t, 1, wal.Pending())
+	assert.NoError(t, wal.Close())
+
+	wal, err = OpenWal(dir, 0)
+	assert.NoError(t, err)
+	defer wal.Close()
+	items, err := wal.Next(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []queueItem{{seq: held[0].seq, report: reports[0]}}, items)
+}
+
+func TestWalCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWal(dir, 0)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	reports := testQueueReports(2)
+	for _, report := range reports {
+		_, err := wal.Append(report)
+		assert.NoError(t, err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY, 0o600)
+	assert.NoError(t, err)
+	_, err = file.WriteAt([]byte("garbage"), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	// The corrupt report is skipped and counted as consumed, so the log
+	// still empties once the other one is delivered.
+	items, err := wal.Next(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []queueItem{{seq: 2, report: reports[1]}}, items)
+	assert.Equal(t, 1, wal.Pending())
+	assert.NoError(t, wal.Ack(items[0].seq))
+	assert.Equal(t, int64(0), wal.size)
+}
+
+type rejectingBackend struct {
+	fakeBackend
+	accept bool
+}
+
+func (b *rejectingBackend) Send(reports []Report) error {
+	b.mu.Lock()
+	accept := b.accept
+	b.mu.Unlock()
+	if !accept {
+		return NewApiError(http.StatusBadRequest, "backend responded with 400 Bad Request")
+	}
+	return b.fakeBackend.Send(reports)
+}
+
+type blockingBackend struct {
+	release chan struct{}
+}
+
+func (b *blockingBackend) Send(reports []Report) error {
+	<-b.release
+	return nil
+}
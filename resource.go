@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/yaml"
+)
+
+// ResourceRule extracts images from objects of a kind without built-in
+// support, such as custom resources.
+type ResourceRule struct {
+	group        string
+	version      string
+	kind         string
+	paths        []string
+	podTemplates bool
+}
+
+type ResourceRules []ResourceRule
+
+// resourceRuleJson is the file representation of a ResourceRule.
+type resourceRuleJson struct {
+	Group        string   `json:"group"`
+	Version      string   `json:"version"`
+	Kind         string   `json:"kind"`
+	Paths        []string `json:"paths"`
+	PodTemplates bool     `json:"podTemplates"`
+}
+
+// LoadResourceRules reads rules from a YAML or JSON file, for example:
+//
+//	# resource-rules.yaml
+//	- group: argoproj.io
+//	  kind: Rollout
+//	  podTemplates: true
+//	- group: tekton.dev
+//	  version: v1
+//	  kind: Task
+//	  paths:
+//	  - "{.spec.steps[*]}"
+//	  - "{.spec.sidecars[*].image}"
+func LoadResourceRules(path string) ([]ConfigResourceRule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []resourceRuleJson{}
+	if err := yaml.UnmarshalStrict(b, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse resource rules %s: %w", path, err)
+	}
+
+	rules := []ConfigResourceRule{}
+	for _, entry := range entries {
+		rules = append(rules, ConfigResourceRule{
+			Group:        entry.Group,
+			Version:      entry.Version,
+			Kind:         entry.Kind,
+			Paths:        entry.Paths,
+			PodTemplates: entry.PodTemplates,
+		})
+	}
+	return rules, nil
+}
+
+func NewResourceRules(config []ConfigResourceRule) (ResourceRules, error) {
+	rules := ResourceRules{}
+	for _, c := range config {
+		if c.Kind == "" {
+			return nil, fmt.Errorf("resource rule for group %q has no kind", c.Group)
+		}
+		if len(c.Paths) == 0 && !c.PodTemplates {
+			return nil, fmt.Errorf("resource rule for %s needs paths or podTemplates", c.Kind)
+		}
+
+		rule := ResourceRule{
+			group:        c.Group,
+			version:      c.Version,
+			kind:         c.Kind,
+			podTemplates: c.PodTemplates,
+		}
+		for _, path := range c.Paths {
+			if _, err := parsePath(path); err != nil {
+				return nil, fmt.Errorf("invalid path %q for %s: %w", path, c.Kind, err)
+			}
+			rule.paths = append(rule.paths, path)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parsePath compiles a JSONPath expression. A parsed expression keeps
+// the state of its range blocks while evaluating, so it is parsed again
+// for every evaluation instead of being shared between requests.
+func parsePath(path string) (*jsonpath.JSONPath, error) {
+	j := jsonpath.New(path).AllowMissingKeys(true)
+	if err := j.Parse(path); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Match returns the first rule for the kind, an empty or "*" rule version
+// matches every version and a "*" rule group every group.
+func (rules ResourceRules) Match(gvk metav1.GroupVersionKind) *ResourceRule {
+	for i, rule := range rules {
+		if (rule.group == "*" || rule.group == gvk.Group) && rule.kind == gvk.Kind && (rule.version == "" || rule.version == "*" || rule.version == gvk.Version) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *AdmissionReview) handleUnstructuredResource(rule *ResourceRule, raw []byte) error {
+	var object any
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return NewApiError(http.StatusBadRequest, err.Error())
+	}
+
+	if rule.podTemplates {
+		if err := r.findPodSpecs(object, ""); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range rule.paths {
+		j, err := parsePath(path)
+		if err != nil {
+			return err
+		}
+		results, err := j.FindResults(object)
+		if err != nil {
+			return NewApiError(http.StatusBadRequest, err.Error())
+		}
+		for _, result := range results {
+			for _, value := range result {
+				r.addUnstructuredContainer(value.Interface())
+			}
+		}
+	}
+	return nil
+}
+
+// addUnstructuredContainer adds a JSONPath result, which is either an
+// image reference or a container-like object with an image field. These
+// containers have no JSON pointer, so they are never mutated.
+func (r *AdmissionReview) addUnstructuredContainer(v any) {
+	switch v := v.(type) {
+	case string:
+		r.addContainer("", v, "")
+	case map[string]any:
+		image, ok := v["image"].(string)
+		if !ok {
+			return
+		}
+		name, _ := v["name"].(string)
+		r.addContainer(name, image, "")
+	}
+}
+
+// findPodSpecs walks an unstructured object and handles every pod spec,
+// recognised by its containers list, found in it.
+func (r *AdmissionReview) findPodSpecs(v any, path string) error {
+	switch v := v.(type) {
+	case map[string]any:
+		if _, ok := v["containers"].([]any); ok {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			spec := corev1.PodSpec{}
+			if err := json.Unmarshal(b, &spec); err != nil {
+				return NewApiError(http.StatusBadRequest, fmt.Sprintf("invalid pod spec at %s: %s", path, err))
+			}
+			return r.handlePodSpec(&spec, path)
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := r.findPodSpecs(v[key], path+"/"+escapeJsonPointer(key)); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for i, item := range v {
+			if err := r.findPodSpecs(item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func escapeJsonPointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
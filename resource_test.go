@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/imperialops/airgap-webhook/admission"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	v1alpha1Rollout = []byte(`apiVersion: argoproj.io/v1alpha1
+kind: Rollout
+metadata:
+  name: rollout-canary
+spec:
+  replicas: 5
+  template:
+    metadata:
+      labels:
+        app: rollout-canary
+    spec:
+      initContainers:
+      - name: migrate
+        image: busybox:1.28
+      containers:
+      - name: rollouts-demo
+        image: argoproj/rollouts-demo:blue
+        ports:
+        - containerPort: 8080`)
+	v1Task = []byte(`apiVersion: tekton.dev/v1
+kind: Task
+metadata:
+  name: build
+spec:
+  steps:
+  - name: compile
+    image: golang:1.20
+  - name: package
+    image: gcr.io/kaniko-project/executor:v1.9.0
+  sidecars:
+  - name: registry
+    image: registry:2`)
+	testResourceRules = `
+- group: argoproj.io
+  kind: Rollout
+  podTemplates: true
+- group: tekton.dev
+  version: v1
+  kind: Task
+  paths:
+  - "{.spec.steps[*]}"
+  - "{.spec.sidecars[*].image}"
+`
+)
+
+func testRules(t *testing.T, content string) ResourceRules {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	config, err := LoadResourceRules(path)
+	assert.NoError(t, err)
+	rules, err := NewResourceRules(config)
+	assert.NoError(t, err)
+	return rules
+}
+
+func TestHandleUnstructuredResource(t *testing.T) {
+	rules := testRules(t, testResourceRules)
+
+	tests := []struct {
+		resource []byte
+		expected []Container
+	}{
+		{v1alpha1Rollout, []Container{
+			{name: "migrate", path: "/spec/template/spec/initContainers/0/image", ref: "busybox:1.28", image: MustImage("busybox:1.28")},
+			{name: "rollouts-demo", path: "/spec/template/spec/containers/0/image", ref: "argoproj/rollouts-demo:blue", image: MustImage("argoproj/rollouts-demo:blue")},
+		}},
+		{v1Task, []Container{
+			{name: "compile", ref: "golang:1.20", image: MustImage("golang:1.20")},
+			{name: "package", ref: "gcr.io/kaniko-project/executor:v1.9.0", image: MustImage("gcr.io/kaniko-project/executor:v1.9.0")},
+			{name: "", ref: "registry:2", image: MustImage("registry:2")},
+		}},
+	}
+
+	for _, test := range tests {
+		bytes, err := admission.CreateAdmissionReviewRequest(test.resource, "create", "imperialops", []string{})
+		assert.NoError(t, err)
+		admissionReview := MustAdmissionReview(bytes)
+		admissionReview.rules = rules
+		assert.NoError(t, admissionReview.handleResource())
+		assert.Equal(t, test.expected, admissionReview.containers)
+	}
+}
+
+func TestHandleUnstructuredResourceRange(t *testing.T) {
+	rules := testRules(t, `
+- group: tekton.dev
+  kind: Task
+  paths:
+  - "{range .spec.steps[*]}{.image}{end}"
+`)
+	expected := []Container{
+		{ref: "golang:1.20", image: MustImage("golang:1.20")},
+		{ref: "gcr.io/kaniko-project/executor:v1.9.0", image: MustImage("gcr.io/kaniko-project/executor:v1.9.0")},
+	}
+	bytes, err := admission.CreateAdmissionReviewRequest(v1Task, "create", "imperialops", []string{})
+	assert.NoError(t, err)
+
+	// Range blocks are evaluated the same on every request, also when
+	// requests are handled concurrently.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 2; j++ {
+				admissionReview := MustAdmissionReview(bytes)
+				admissionReview.rules = rules
+				assert.NoError(t, admissionReview.handleResource())
+				assert.Equal(t, expected, admissionReview.containers)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestResourceRulesMatch(t *testing.T) {
+	rules := testRules(t, testResourceRules)
+
+	bytes, err := admission.CreateAdmissionReviewRequest(v1Task, "create", "imperialops", []string{})
+	assert.NoError(t, err)
+	admissionReview := MustAdmissionReview(bytes)
+	assert.NotNil(t, rules.Match(admissionReview.Request.Kind))
+
+	admissionReview.Request.Kind.Version = "v1beta1"
+	assert.Nil(t, rules.Match(admissionReview.Request.Kind))
+	admissionReview.Request.Kind.Group = "argoproj.io"
+	admissionReview.Request.Kind.Kind = "Rollout"
+	assert.NotNil(t, rules.Match(admissionReview.Request.Kind))
+
+	rules, err = NewResourceRules([]ConfigResourceRule{{Group: "*", Version: "*", Kind: "Task", PodTemplates: true}})
+	assert.NoError(t, err)
+	admissionReview.Request.Kind.Group = "example.com"
+	admissionReview.Request.Kind.Kind = "Task"
+	assert.NotNil(t, rules.Match(admissionReview.Request.Kind))
+}
+
+func TestNewResourceRulesErrors(t *testing.T) {
+	tests := [][]ConfigResourceRule{
+		{{Group: "tekton.dev", PodTemplates: true}},
+		{{Group: "tekton.dev", Kind: "Task"}},
+		{{Group: "tekton.dev", Kind: "Task", Paths: []string{"{.spec.steps[*"}}},
+	}
+
+	for _, test := range tests {
+		_, err := NewResourceRules(test)
+		assert.Error(t, err)
+	}
+}
+
+func TestHandlePostMutateUnstructured(t *testing.T) {
+	s := &ApiServerCommon{
+		config:  &Config{},
+		rules:   testRules(t, testResourceRules),
+		mutator: &Mutator{mirror: testMirror(t, "docker.io=mirror.internal/docker.io")},
+	}
+
+	response := postMutate(t, s, v1alpha1Rollout)
+	assert.JSONEq(t, `[
+		{"op": "replace", "path": "/spec/template/spec/initContainers/0/image", "value": "mirror.internal/docker.io/library/busybox:1.28"},
+		{"op": "replace", "path": "/spec/template/spec/containers/0/image", "value": "mirror.internal/docker.io/argoproj/rollouts-demo:blue"}
+	]`, string(response.Patch))
+
+	// Images found by JSONPath have no pointer and are left alone.
+	response = postMutate(t, s, v1Task)
+	assert.Nil(t, response.Patch)
+}
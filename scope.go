@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// defaultExcludedNamespaces are the system namespaces the webhook leaves
+// alone unless configured otherwise.
+var defaultExcludedNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// namespaceSyncTimeout bounds the wait for the first list of namespaces.
+const namespaceSyncTimeout = 30 * time.Second
+
+// INamespaceLabels looks up the labels of a namespace, the admission
+// request only carries its name.
+type INamespaceLabels interface {
+	NamespaceLabels(namespace string) (labels.Set, error)
+}
+
+// Scope decides which requests the webhook inspects, requests out of
+// scope are allowed untouched.
+type Scope struct {
+	namespaces         map[string]bool
+	excludedNamespaces map[string]bool
+	namespaceSelector  labels.Selector
+	objectSelector     labels.Selector
+	namespaceLabels    INamespaceLabels
+}
+
+func NewScope(config ConfigScope, namespaceLabels INamespaceLabels) (*Scope, error) {
+	namespaceSelector, err := labels.Parse(config.NamespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector: %w", err)
+	}
+	objectSelector, err := labels.Parse(config.ObjectSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object selector: %w", err)
+	}
+	if !namespaceSelector.Empty() && namespaceLabels == nil {
+		return nil, fmt.Errorf("namespace selector %q requires access to the kubernetes api", config.NamespaceSelector)
+	}
+
+	return &Scope{
+		namespaces:         setOf(config.Namespaces),
+		excludedNamespaces: setOf(config.ExcludedNamespaces),
+		namespaceSelector:  namespaceSelector,
+		objectSelector:     objectSelector,
+		namespaceLabels:    namespaceLabels,
+	}, nil
+}
+
+// ParseNamespaces parses a comma separated list of namespaces, such as the
+// NAMESPACE environment variable.
+func ParseNamespaces(s string) []string {
+	namespaces := []string{}
+	for _, namespace := range strings.Split(s, ",") {
+		if namespace = strings.TrimSpace(namespace); namespace != "" {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// Match reports whether the request is in scope. Namespace lists and the
+// namespace selector only apply to namespaced objects, the object
+// selector matches when either the old or the new object matches, as for
+// webhook configurations.
+func (s *Scope) Match(r *AdmissionReview) (bool, error) {
+	if s == nil {
+		return true, nil
+	}
+
+	if namespace := r.Request.Namespace; namespace != "" {
+		if s.excludedNamespaces[namespace] {
+			return false, nil
+		}
+		if len(s.namespaces) > 0 && !s.namespaces[namespace] {
+			return false, nil
+		}
+		if !s.namespaceSelector.Empty() {
+			namespaceLabels, err := s.namespaceLabels.NamespaceLabels(namespace)
+			if err != nil {
+				return false, NewApiError(http.StatusInternalServerError, fmt.Sprintf("unable to get labels of namespace %s: %s", namespace, err))
+			}
+			if !s.namespaceSelector.Matches(namespaceLabels) {
+				return false, nil
+			}
+		}
+	}
+
+	if !s.objectSelector.Empty() {
+		for _, raw := range [][]byte{r.Request.Object.Raw, r.Request.OldObject.Raw} {
+			if len(raw) == 0 {
+				continue
+			}
+			object, err := objectMeta(raw)
+			if err != nil {
+				return false, err
+			}
+			if s.objectSelector.Matches(labels.Set(object.Labels)) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func setOf(items []string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// NamespaceInformer serves namespace labels from a watched cache.
+type NamespaceInformer struct {
+	lister listersv1.NamespaceLister
+	synced cache.InformerSynced
+	stop   <-chan struct{}
+}
+
+// NewNamespaceInformer starts watching namespaces until stop is closed.
+// The cache is empty until WaitForSync succeeds.
+func NewNamespaceInformer(client kubernetes.Interface, stop <-chan struct{}) *NamespaceInformer {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	informer := factory.Core().V1().Namespaces()
+	n := &NamespaceInformer{
+		lister: informer.Lister(),
+		synced: informer.Informer().HasSynced,
+		stop:   stop,
+	}
+	factory.Start(stop)
+	return n
+}
+
+// WaitForSync waits up to timeout for the namespaces to be listed, which
+// fails when the api server cannot be reached or namespaces cannot be
+// listed and watched.
+func (n *NamespaceInformer) WaitForSync(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-n.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), n.synced) {
+		return fmt.Errorf("namespaces not listed within %s, check the connection to the api server and the permission to list and watch namespaces", timeout)
+	}
+	return nil
+}
+
+func (n *NamespaceInformer) NamespaceLabels(namespace string) (labels.Set, error) {
+	ns, err := n.lister.Get(namespace)
+	if err != nil {
+		return nil, err
+	}
+	return labels.Set(ns.Labels), nil
+}
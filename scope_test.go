@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func testNamespaceInformer(t *testing.T) *NamespaceInformer {
+	client := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"airgap": "enabled"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "sandbox"}},
+	)
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+
+	informer := NewNamespaceInformer(client, stop)
+	assert.NoError(t, informer.WaitForSync(5*time.Second))
+	return informer
+}
+
+func TestNamespaceInformerSyncTimeout(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("list", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New(`namespaces is forbidden: User "system:serviceaccount:airgap:airgap-webhook" cannot list resource "namespaces"`)
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// A missing permission fails the wait instead of blocking it.
+	informer := NewNamespaceInformer(client, stop)
+	assert.Error(t, informer.WaitForSync(100*time.Millisecond))
+}
+
+func scopeReview(namespace string, object string) *AdmissionReview {
+	admissionReview := &AdmissionReview{}
+	admissionReview.Request = &admissionv1.AdmissionRequest{
+		Namespace: namespace,
+		Object:    runtime.RawExtension{Raw: []byte(object)},
+	}
+	return admissionReview
+}
+
+// namespaced returns a yaml resource in namespace.
+func namespaced(resource []byte, namespace string) []byte {
+	return bytes.Replace(resource, []byte("metadata:\n"), []byte("metadata:\n  namespace: "+namespace+"\n"), 1)
+}
+
+func TestScopeMatch(t *testing.T) {
+	pod := `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web"}}`
+	labeled := `{"apiVersion": "v1", "kind": "Pod", "metadata": {"name": "web", "labels": {"app": "web"}}}`
+
+	tests := []struct {
+		name      string
+		config    ConfigScope
+		namespace string
+		object    string
+		expected  bool
+	}{
+		{"all namespaces", ConfigScope{}, "default", pod, true},
+		{"excluded", ConfigScope{ExcludedNamespaces: defaultExcludedNamespaces}, "kube-system", pod, false},
+		{"not excluded", ConfigScope{ExcludedNamespaces: defaultExcludedNamespaces}, "default", pod, true},
+		{"cluster scoped", ConfigScope{Namespaces: []string{"default"}}, "", pod, true},
+		{"included", ConfigScope{Namespaces: []string{"default", "payments"}}, "payments", pod, true},
+		{"not included", ConfigScope{Namespaces: []string{"default"}}, "payments", pod, false},
+		{"excluded wins", ConfigScope{Namespaces: []string{"payments"}, ExcludedNamespaces: []string{"payments"}}, "payments", pod, false},
+		{"namespace selector", ConfigScope{NamespaceSelector: "airgap=enabled"}, "payments", pod, true},
+		{"namespace selector mismatch", ConfigScope{NamespaceSelector: "airgap=enabled"}, "sandbox", pod, false},
+		{"namespace selector negation", ConfigScope{NamespaceSelector: "airgap!=disabled"}, "sandbox", pod, true},
+		{"object selector", ConfigScope{ObjectSelector: "app=web"}, "default", labeled, true},
+		{"object selector mismatch", ConfigScope{ObjectSelector: "app=web"}, "default", pod, false},
+	}
+
+	informer := testNamespaceInformer(t)
+	for _, test := range tests {
+		scope, err := NewScope(test.config, informer)
+		assert.NoError(t, err, test.name)
+
+		ok, err := scope.Match(scopeReview(test.namespace, test.object))
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.expected, ok, test.name)
+	}
+
+	// Namespaces missing from the cache fail the request.
+	scope, err := NewScope(ConfigScope{NamespaceSelector: "airgap=enabled"}, informer)
+	assert.NoError(t, err)
+	_, err = scope.Match(scopeReview("missing", pod))
+	assert.Error(t, err)
+
+	_, err = NewScope(ConfigScope{NamespaceSelector: "airgap=enabled"}, nil)
+	assert.Error(t, err)
+	_, err = NewScope(ConfigScope{ObjectSelector: "app in (web"}, nil)
+	assert.Error(t, err)
+}
+
+func TestParseNamespaces(t *testing.T) {
+	assert.Equal(t, []string{}, ParseNamespaces(""))
+	assert.Equal(t, []string{"default", "payments"}, ParseNamespaces("default, payments,"))
+}
+
+func TestHandlePostValidateScope(t *testing.T) {
+	backend := &fakeBackend{}
+	scope, err := NewScope(ConfigScope{ExcludedNamespaces: []string{"imperialops"}}, nil)
+	assert.NoError(t, err)
+	s := &ApiServerCommon{
+		config:  &Config{},
+		backend: backend,
+		scope:   scope,
+		policy: NewPolicy(ConfigPolicy{
+			Registries: ConfigRegistryPolicy{Mode: PolicyModeEnforce, Allowed: []string{"mirror.internal"}},
+		}, nil, nil, nil),
+		mutator: &Mutator{mirror: testMirror(t, "docker.io=mirror.internal/docker.io")},
+	}
+
+	w := postValidate(t, s, namespaced(v1Job, "imperialops"))
+	assert.True(t, decodeResponse(t, w.Body.Bytes()).Allowed)
+	assert.Empty(t, backend.Reports())
+	assert.Empty(t, postMutate(t, s, namespaced(v1Job, "imperialops")).Patch)
+
+	w = postValidate(t, s, namespaced(v1Job, "default"))
+	assert.False(t, decodeResponse(t, w.Body.Bytes()).Allowed)
+	assert.NotEmpty(t, postMutate(t, s, namespaced(v1Job, "default")).Patch)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+var (
+	imagesBucket    = []byte("images")
+	workloadsBucket = []byte("workloads")
+)
+
+// IHealthCheck is implemented by backends that can report on their own
+// health.
+type IHealthCheck interface {
+	Healthy() error
+}
+
+// Workload identifies an object that references images.
+type Workload struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+}
+
+// ImageRecord is the inventory entry of a single image.
+type ImageRecord struct {
+	Image     Image      `json:"image"`
+	FirstSeen time.Time  `json:"firstSeen"`
+	LastSeen  time.Time  `json:"lastSeen"`
+	Workloads []Workload `json:"workloads"`
+}
+
+// WorkloadRecord is the inventory entry of a single workload.
+type WorkloadRecord struct {
+	Workload
+	Images     []Image    `json:"images"`
+	Operation  string     `json:"operation"`
+	Violations []string   `json:"violations,omitempty"`
+	Exemption  *Exemption `json:"exemption,omitempty"`
+	FirstSeen  time.Time  `json:"firstSeen"`
+	LastSeen   time.Time  `json:"lastSeen"`
+}
+
+// BoltStore is an embedded inventory backed by a bbolt database file.
+type BoltStore struct {
+	db  *bolt.DB
+	now func() time.Time
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{imagesBucket, workloadsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{
+		db:  db,
+		now: time.Now,
+	}, nil
+}
+
+func (w Workload) key() []byte {
+	return []byte(w.Namespace + "/" + w.Kind + "/" + w.Name)
+}
+
+func (s *BoltStore) Send(reports []Report) error {
+	now := s.now().UTC()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		images := tx.Bucket(imagesBucket)
+		workloads := tx.Bucket(workloadsBucket)
+
+		for _, report := range reports {
+			workload := report.Workload()
+			record := WorkloadRecord{}
+			if err := getJson(workloads, workload.key(), &record); err != nil {
+				return err
+			}
+
+			// Images the workload referenced before but not anymore no
+			// longer list it, the stored record catches reports missed
+			// in between.
+			for _, image := range subtractImages(append(record.Images, report.Removed...), report.Images) {
+				if err := s.unreference(images, image, workload); err != nil {
+					return err
+				}
+			}
+			if report.Operation == string(admissionv1.Delete) {
+				if err := workloads.Delete(workload.key()); err != nil {
+					return err
+				}
+				continue
+			}
+
+			for _, image := range report.Images {
+				record := ImageRecord{}
+				if err := getJson(images, []byte(image.String()), &record); err != nil {
+					return err
+				}
+				if record.FirstSeen.IsZero() {
+					record.Image = image
+					record.FirstSeen = now
+				}
+				record.LastSeen = now
+				if !containsWorkload(record.Workloads, workload) {
+					record.Workloads = append(record.Workloads, workload)
+				}
+				if err := putJson(images, []byte(image.String()), record); err != nil {
+					return err
+				}
+			}
+
+			if record.FirstSeen.IsZero() {
+				record.Workload = workload
+				record.FirstSeen = now
+			}
+			record.LastSeen = now
+			record.Operation = report.Operation
+			record.Images = report.Images
+			record.Violations = report.Violations
+			record.Exemption = report.Exemption
+			if err := putJson(workloads, workload.key(), record); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// unreference removes workload from the workloads of image. The image
+// stays in the inventory with the time it was last seen.
+func (s *BoltStore) unreference(images *bolt.Bucket, image Image, workload Workload) error {
+	record := ImageRecord{}
+	if err := getJson(images, []byte(image.String()), &record); err != nil {
+		return err
+	}
+	if record.FirstSeen.IsZero() {
+		return nil
+	}
+	workloads := []Workload{}
+	for _, w := range record.Workloads {
+		if w != workload {
+			workloads = append(workloads, w)
+		}
+	}
+	record.Workloads = workloads
+	return putJson(images, []byte(image.String()), record)
+}
+
+// Image returns the inventory entry of an image, or nil if it has never
+// been seen.
+func (s *BoltStore) Image(image Image) (*ImageRecord, error) {
+	record := &ImageRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket(imagesBucket), []byte(image.String()), record)
+	})
+	if err != nil || record.FirstSeen.IsZero() {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *BoltStore) Images(filter ImageFilter) ([]ImageRecord, error) {
+	records := []ImageRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).ForEach(func(k, v []byte) error {
+			record := ImageRecord{}
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if filter.Match(record) {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	return records, err
+}
+
+// Workload returns the inventory entry of a workload, or nil if it has
+// never been seen.
+func (s *BoltStore) Workload(workload Workload) (*WorkloadRecord, error) {
+	record := &WorkloadRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return getJson(tx.Bucket(workloadsBucket), workload.key(), record)
+	})
+	if err != nil || record.FirstSeen.IsZero() {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (s *BoltStore) Healthy() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func containsWorkload(workloads []Workload, workload Workload) bool {
+	for _, w := range workloads {
+		if w == workload {
+			return true
+		}
+	}
+	return false
+}
+
+// getJson decodes the value stored under key into v, leaving v untouched
+// when the key does not exist.
+func getJson(bucket *bolt.Bucket, key []byte, v any) error {
+	b := bucket.Get(key)
+	if b == nil {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
+
+func putJson(bucket *bolt.Bucket, key []byte, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, b)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBoltStore(t *testing.T) (*BoltStore, *time.Time) {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "inventory.db"))
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	return store, &now
+}
+
+func TestBoltStoreSend(t *testing.T) {
+	store, now := newTestBoltStore(t)
+	firstSeen := *now
+
+	nginx := MustImage("nginx:stable@sha256:f3c37d8a26f7a7d8a547470c58733f270bcccb7e785da17af81ec41576170da8")
+	busybox := MustImage("busybox:1.28")
+
+	assert.NoError(t, store.Send([]Report{
+		{Namespace: "default", Kind: "Deployment", Name: "web", Operation: "CREATE", Images: []Image{nginx, busybox}},
+	}))
+
+	*now = now.Add(time.Hour)
+	assert.NoError(t, store.Send([]Report{
+		{Namespace: "default", Kind: "Deployment", Name: "web", Operation: "UPDATE", Images: []Image{nginx, busybox}},
+		{Namespace: "batch", Kind: "Job", Name: "migrate", Operation: "CREATE", Images: []Image{busybox}},
+	}))
+
+	record, err := store.Image(busybox)
+	assert.NoError(t, err)
+	assert.Equal(t, &ImageRecord{
+		Image:     busybox,
+		FirstSeen: firstSeen,
+		LastSeen:  *now,
+		Workloads: []Workload{
+			{Namespace: "default", Kind: "Deployment", Name: "web"},
+			{Namespace: "batch", Kind: "Job", Name: "migrate"},
+		},
+	}, record)
+
+	record, err = store.Image(nginx)
+	assert.NoError(t, err)
+	assert.Equal(t, []Workload{{Namespace: "default", Kind: "Deployment", Name: "web"}}, record.Workloads)
+
+	// Images with the same repository but a different tag are tracked
+	// separately.
+	record, err = store.Image(MustImage("busybox:1.36"))
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+}
+
+func TestBoltStoreSendUpdateDelete(t *testing.T) {
+	store, now := newTestBoltStore(t)
+	web := Workload{Namespace: "default", Kind: "Deployment", Name: "web"}
+	migrate := Workload{Namespace: "default", Kind: "Job", Name: "migrate"}
+
+	nginx := MustImage("nginx:1.24")
+	nginxNew := MustImage("nginx:1.25")
+	busybox := MustImage("busybox:1.28")
+
+	assert.NoError(t, store.Send([]Report{
+		{Namespace: "default", Kind: "Deployment", Name: "web", Operation: "CREATE", Images: []Image{nginx, busybox}},
+		{Namespace: "default", Kind: "Job", Name: "migrate", Operation: "CREATE", Images: []Image{busybox}},
+	}))
+
+	*now = now.Add(time.Hour)
+	assert.NoError(t, store.Send([]Report{
+		{Namespace: "default", Kind: "Deployment", Name: "web", Operation: "UPDATE", Images: []Image{nginxNew, busybox}, Added: []Image{nginxNew}, Removed: []Image{nginx}},
+	}))
+
+	record, err := store.Image(nginx)
+	assert.NoError(t, err)
+	assert.Empty(t, record.Workloads, "replaced images are no longer referenced")
+	record, err = store.Image(nginxNew)
+	assert.NoError(t, err)
+	assert.Equal(t, []Workload{web}, record.Workloads)
+
+	assert.NoError(t, store.Send([]Report{
+		{Namespace: "default", Kind: "Deployment", Name: "web", Operation: "DELETE", Images: []Image{}, Removed: []Image{nginxNew, busybox}},
+	}))
+
+	workload, err := store.Workload(web)
+	assert.NoError(t, err)
+	assert.Nil(t, workload)
+	record, err = store.Image(nginxNew)
+	assert.NoError(t, err)
+	assert.Empty(t, record.Workloads)
+	assert.Equal(t, *now, record.LastSeen)
+	record, err = store.Image(busybox)
+	assert.NoError(t, err)
+	assert.Equal(t, []Workload{migrate}, record.Workloads)
+
+	// Deletes without an old object still unreference the stored images.
+	assert.NoError(t, store.Send([]Report{
+		{Namespace: "default", Kind: "Job", Name: "migrate", Operation: "DELETE", Images: []Image{}},
+	}))
+	record, err = store.Image(busybox)
+	assert.NoError(t, err)
+	assert.Empty(t, record.Workloads)
+}
+
+func TestBoltStoreSendExemption(t *testing.T) {
+	store, now := newTestBoltStore(t)
+	exemption := &Exemption{Reason: "INC-1234", User: "oncall", Time: *now}
+
+	assert.NoError(t, store.Send([]Report{
+		{Namespace: "default", Kind: "Job", Name: "restore", Operation: "CREATE", Images: []Image{MustImage("vendor.example.com/restore:2.1")}, Exemption: exemption},
+	}))
+
+	record, err := store.Workload(Workload{Namespace: "default", Kind: "Job", Name: "restore"})
+	assert.NoError(t, err)
+	assert.Equal(t, exemption, record.Exemption)
+}
+
+func TestBoltStoreHealthy(t *testing.T) {
+	store, _ := newTestBoltStore(t)
+	assert.NoError(t, store.Healthy())
+
+	store.Close()
+	assert.Error(t, store.Healthy())
+
+	s := &ApiServerCommon{config: &Config{}, backend: store}
+	assert.False(t, s.isServerHealthy())
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	walFileName = "queue.wal"
+
+	// walCompactSize is the file size above which the log is rewritten
+	// once more than half of it is delivered reports and acks.
+	walCompactSize = 1 << 20
+)
+
+var ErrWalFull = errors.New("write-ahead log is full")
+
+// Wal is an append-only log of reports waiting to be delivered. Reports
+// are appended when queued and acknowledged once the backend stored them,
+// anything left unacknowledged is replayed when the log is reopened.
+//
+// Appends are synced to disk before they return, so queued reports survive
+// a crash of the node. Acks are not synced, a crash may replay reports the
+// backend already stored.
+type Wal struct {
+	mu          sync.Mutex
+	file        *os.File
+	path        string
+	maxSize     int64
+	compactSize int64
+	size        int64
+	readOffset  int64
+	seq         uint64
+	// pending locates the record of every report not yet acknowledged,
+	// live is their total size and what maxSize limits.
+	pending map[uint64]walEntry
+	live    int64
+}
+
+type walEntry struct {
+	offset int64
+	length int64
+}
+
+type walRecord struct {
+	Seq    uint64  `json:"seq"`
+	Ack    bool    `json:"ack,omitempty"`
+	Report *Report `json:"report,omitempty"`
+}
+
+func OpenWal(dir string, maxSize int64) (*Wal, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, walFileName)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Every report is pending until its ack is found, the log is then
+	// compacted down to the records that still need delivering.
+	l := &Wal{
+		file:        file,
+		path:        path,
+		maxSize:     maxSize,
+		compactSize: walCompactSize,
+		size:        info.Size(),
+		pending:     map[uint64]walEntry{},
+	}
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A trailing partial line is a write interrupted by a crash.
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		entry := walEntry{offset: offset, length: int64(len(line))}
+		offset += entry.length
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("skipping corrupt record in %s: %s", path, err)
+			continue
+		}
+		if record.Seq > l.seq {
+			l.seq = record.Seq
+		}
+		if record.Ack {
+			delete(l.pending, record.Seq)
+		} else if record.Report != nil {
+			l.pending[record.Seq] = entry
+		}
+	}
+	if err := l.compact(); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	if len(l.pending) > 0 {
+		log.Printf("replaying %d reports from %s", len(l.pending), path)
+	}
+	return l, nil
+}
+
+func writeWalRecord(w io.Writer, record walRecord) (int, error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(append(b, '\n'))
+}
+
+// Append writes the report to the log and returns its sequence number once
+// it is on disk. The log is full when the reports not yet acknowledged
+// take up maxSize.
+func (l *Wal) Append(report Report) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, err := json.Marshal(walRecord{Seq: l.seq + 1, Report: &report})
+	if err != nil {
+		return 0, err
+	}
+	b = append(b, '\n')
+	if l.maxSize > 0 && l.live+int64(len(b)) > l.maxSize {
+		return 0, ErrWalFull
+	}
+	if _, err := l.file.Write(b); err != nil {
+		return 0, err
+	}
+	if err := l.file.Sync(); err != nil {
+		return 0, err
+	}
+
+	l.seq++
+	l.pending[l.seq] = walEntry{offset: l.size, length: int64(len(b))}
+	l.size += int64(len(b))
+	l.live += int64(len(b))
+	return l.seq, nil
+}
+
+// Next returns up to max reports that have been appended but not yet
+// handed out. Corrupt records are skipped, a report lost that way is
+// dropped from the pending ones.
+func (l *Wal) Next(max int) ([]queueItem, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	items := []queueItem{}
+	r := bufio.NewReader(io.NewSectionReader(l.file, l.readOffset, l.size-l.readOffset))
+	for len(items) < max && l.readOffset < l.size {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return items, err
+		}
+		offset := l.readOffset
+		l.readOffset += int64(len(line))
+
+		var record walRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			log.Printf("skipping corrupt write-ahead log record at offset %d: %s", offset, err)
+			l.dropAt(offset)
+			continue
+		}
+		if record.Ack || record.Report == nil {
+			continue
+		}
+		if entry, ok := l.pending[record.Seq]; !ok || entry.offset != offset {
+			continue
+		}
+		items = append(items, queueItem{seq: record.Seq, report: *record.Report})
+	}
+	return items, nil
+}
+
+// dropAt forgets the pending report whose record starts at offset.
+func (l *Wal) dropAt(offset int64) {
+	for seq, entry := range l.pending {
+		if entry.offset == offset {
+			log.Printf("dropping report %d with a corrupt write-ahead log record", seq)
+			delete(l.pending, seq)
+			l.live -= entry.length
+			return
+		}
+	}
+}
+
+// Ack marks reports as delivered. The log is truncated once every report
+// in it has been delivered, and compacted once mostly delivered reports
+// are left in it.
+func (l *Wal) Ack(seqs ...uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w := bufio.NewWriter(l.file)
+	var size int64
+	for _, seq := range seqs {
+		n, err := writeWalRecord(w, walRecord{Seq: seq, Ack: true})
+		if err != nil {
+			return err
+		}
+		size += int64(n)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	l.size += size
+	for _, seq := range seqs {
+		if entry, ok := l.pending[seq]; ok {
+			delete(l.pending, seq)
+			l.live -= entry.length
+		}
+	}
+
+	switch {
+	case len(l.pending) == 0:
+		if err := l.file.Truncate(0); err != nil {
+			return err
+		}
+		l.size = 0
+		l.readOffset = 0
+	case l.size > l.compactSize && l.size > 2*l.live:
+		return l.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log with only the records of pending reports, in
+// order, and moves the read offset to the first one not yet handed out.
+func (l *Wal) compact() error {
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	entries := make([]walEntry, 0, len(l.pending))
+	seqs := map[int64]uint64{}
+	for seq, entry := range l.pending {
+		entries = append(entries, entry)
+		seqs[entry.offset] = seq
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].offset < entries[j].offset })
+
+	w := bufio.NewWriter(tmp)
+	pending := make(map[uint64]walEntry, len(entries))
+	var size, readOffset int64
+	for _, entry := range entries {
+		if entry.offset < l.readOffset {
+			readOffset = size + entry.length
+		}
+		line := make([]byte, entry.length)
+		if _, err := l.file.ReadAt(line, entry.offset); err != nil {
+			tmp.Close()
+			return err
+		}
+		if _, err := w.Write(line); err != nil {
+			tmp.Close()
+			return err
+		}
+		pending[seqs[entry.offset]] = walEntry{offset: size, length: entry.length}
+		size += entry.length
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(l.path)); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	l.size = size
+	l.live = size
+	l.readOffset = readOffset
+	l.pending = pending
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Pending returns the number of reports not yet acknowledged.
+func (l *Wal) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.pending)
+}
+
+func (l *Wal) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}